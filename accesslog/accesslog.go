@@ -0,0 +1,268 @@
+// Package accesslog records one line per request handled by a listener,
+// attributing it to the mapping and upstream calls that served it.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry collects the details of a request while it is handled, it is safe
+// for concurrent use and its methods do nothing on a nil entry.
+type Entry struct {
+	lock            sync.Mutex
+	done            bool
+	started         time.Time
+	request         *http.Request
+	mapping         string
+	cache           string
+	upstreamUris    []string
+	upstreamStatus  []string
+	upstreamStarted time.Time
+	upstreamEnded   time.Time
+	status          int
+	bytes           int64
+}
+
+// Mapping records the id of the mapping serving the request.
+func (e *Entry) Mapping(id string) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.mapping = id
+}
+
+// Cache records the cache result of the request (hit, stale or miss).
+func (e *Entry) Cache(result string) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.cache = result
+}
+
+// Upstream records an upstream call started at started, status is 0 when
+// the call failed without a response.
+func (e *Entry) Upstream(uri string, status int, started time.Time) {
+	if e == nil {
+		return
+	}
+	ended := time.Now()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.done {
+		return
+	}
+	e.upstreamUris = append(e.upstreamUris, uri)
+	if status == 0 {
+		e.upstreamStatus = append(e.upstreamStatus, "-")
+	} else {
+		e.upstreamStatus = append(e.upstreamStatus, fmt.Sprintf("%d", status))
+	}
+	if e.upstreamStarted.IsZero() || started.Before(e.upstreamStarted) {
+		e.upstreamStarted = started
+	}
+	if ended.After(e.upstreamEnded) {
+		e.upstreamEnded = ended
+	}
+}
+
+// Record is the logged form of an entry.
+type Record struct {
+	Time            string   `json:"time"`
+	RequestId       string   `json:"request_id,omitempty"`
+	RemoteAddr      string   `json:"remote_addr"`
+	Method          string   `json:"method"`
+	Path            string   `json:"path"`
+	Uri             string   `json:"uri"`
+	Protocol        string   `json:"protocol"`
+	Mapping         string   `json:"mapping,omitempty"`
+	UpstreamUri     string   `json:"upstream_uri,omitempty"`
+	UpstreamStatus  string   `json:"upstream_status,omitempty"`
+	Status          int      `json:"status"`
+	Bytes           int64    `json:"bytes"`
+	Cache           string   `json:"cache,omitempty"`
+	UpstreamLatency *float64 `json:"upstream_latency_seconds,omitempty"`
+	Latency         float64  `json:"latency_seconds"`
+	Referer         string   `json:"referer,omitempty"`
+	UserAgent       string   `json:"user_agent,omitempty"`
+}
+
+func (e *Entry) record() *Record {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.done = true
+	r := &Record{
+		Time:           e.started.Format(time.RFC3339Nano),
+		RequestId:      e.request.Header.Get("X-Request-Id"),
+		RemoteAddr:     e.request.RemoteAddr,
+		Method:         e.request.Method,
+		Path:           e.request.URL.Path,
+		Uri:            e.request.RequestURI,
+		Protocol:       e.request.Proto,
+		Mapping:        e.mapping,
+		UpstreamUri:    strings.Join(e.upstreamUris, ","),
+		UpstreamStatus: strings.Join(e.upstreamStatus, ","),
+		Status:         e.status,
+		Bytes:          e.bytes,
+		Cache:          e.cache,
+		Latency:        time.Since(e.started).Seconds(),
+		Referer:        e.request.Referer(),
+		UserAgent:      e.request.UserAgent(),
+	}
+	if len(e.upstreamUris) > 0 {
+		latency := e.upstreamEnded.Sub(e.upstreamStarted).Seconds()
+		r.UpstreamLatency = &latency
+	}
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	return r
+}
+
+// responseWriter tracks the status and size of the response of an entry.
+type responseWriter struct {
+	http.ResponseWriter
+	entry *Entry
+}
+
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	rw.entry.lock.Lock()
+	if rw.entry.status == 0 {
+		rw.entry.status = statusCode
+	}
+	rw.entry.lock.Unlock()
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(p)
+	rw.entry.lock.Lock()
+	if rw.entry.status == 0 {
+		rw.entry.status = http.StatusOK
+	}
+	rw.entry.bytes += int64(n)
+	rw.entry.lock.Unlock()
+	return n, err
+}
+
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// From returns the entry of a response writer created by a Logger, or nil.
+func From(w http.ResponseWriter) *Entry {
+	for w != nil {
+		if rw, ok := w.(*responseWriter); ok {
+			return rw.entry
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = unwrapper.Unwrap()
+	}
+	return nil
+}
+
+// Logger writes access log lines in the combined log format or as json.
+type Logger struct {
+	json   bool
+	lock   sync.Mutex
+	output io.Writer
+}
+
+// New creates a logger from an access_log config section: "format"
+// (combined or json), "output" (stdout, stderr or a file path) and for files
+// "max_size_mb" and "max_backups" controlling rotation.
+func New(config map[string]interface{}) (*Logger, error) {
+	logger := &Logger{output: os.Stdout}
+	switch format, _ := config["format"].(string); format {
+	case "", "combined":
+	case "json":
+		logger.json = true
+	default:
+		return nil, fmt.Errorf("unknown access log format '%s'", format)
+	}
+	switch output, _ := config["output"].(string); output {
+	case "", "stdout":
+	case "stderr":
+		logger.output = os.Stderr
+	default:
+		maxSize, _ := config["max_size_mb"].(float64)
+		maxBackups, ok := config["max_backups"].(float64)
+		if !ok {
+			maxBackups = 5
+		}
+		file, err := openRotating(output, int64(maxSize*1024*1024), int(maxBackups))
+		if err != nil {
+			return nil, err
+		}
+		logger.output = file
+	}
+	return logger, nil
+}
+
+// Wrap logs every request served by handler.
+func (l *Logger) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &Entry{started: time.Now(), request: r}
+		defer func() {
+			l.write(entry.record())
+		}()
+		handler.ServeHTTP(&responseWriter{ResponseWriter: w, entry: entry}, r)
+	})
+}
+
+func (l *Logger) write(r *Record) {
+	var line string
+	if l.json {
+		bytes, _ := json.Marshal(r)
+		line = string(bytes) + "\n"
+	} else {
+		line = combined(r)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	io.WriteString(l.output, line)
+}
+
+// combined formats a record in the combined log format followed by the
+// mapping attribution and timings.
+func combined(r *Record) string {
+	host := r.RemoteAddr
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		host = host[:i]
+	}
+	started, _ := time.Parse(time.RFC3339Nano, r.Time)
+	upstreamLatency := "-"
+	if r.UpstreamLatency != nil {
+		upstreamLatency = fmt.Sprintf("%.3f", *r.UpstreamLatency)
+	}
+	return fmt.Sprintf("%s - - [%s] %q %d %d %q %q request_id=%s mapping=%s upstream=%s upstream_status=%s cache=%s upstream_time=%s request_time=%.3f\n",
+		host, started.Format("02/Jan/2006:15:04:05 -0700"), r.Method+" "+r.Uri+" "+r.Protocol, r.Status, r.Bytes,
+		orDash(r.Referer), orDash(r.UserAgent), orDash(r.RequestId),
+		orDash(r.Mapping), orDash(r.UpstreamUri), orDash(r.UpstreamStatus), orDash(r.Cache), upstreamLatency, r.Latency)
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
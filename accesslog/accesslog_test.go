@@ -0,0 +1,98 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(logger *Logger) {
+	handler := logger.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := From(w)
+		entry.Mapping("search")
+		entry.Cache("miss")
+		entry.Upstream("http://es:9200/_search", 200, time.Now())
+		w.WriteHeader(201)
+		fmt.Fprint(w, "hello")
+	}))
+	request := httptest.NewRequest("GET", "/search?q=1", nil)
+	request.Header.Set("User-Agent", "test")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+}
+
+func TestJson(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := New(map[string]interface{}{"format": "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.output = &buffer
+	serve(logger)
+
+	var record Record
+	if err := json.Unmarshal(buffer.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Mapping != "search" || record.Status != 201 || record.Bytes != 5 || record.Cache != "miss" ||
+		record.UpstreamUri != "http://es:9200/_search" || record.UpstreamStatus != "200" || record.UpstreamLatency == nil {
+		t.Errorf("unexpected record: %s", buffer.String())
+	}
+}
+
+func TestCombined(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, _ := New(map[string]interface{}{})
+	logger.output = &buffer
+	serve(logger)
+
+	line := buffer.String()
+	if !strings.HasPrefix(line, "192.0.2.1 - - [") || !strings.Contains(line, `] "GET /search?q=1 HTTP/1.1" 201 5 "-" "test" request_id=- mapping=search upstream=http://es:9200/_search upstream_status=200 cache=miss upstream_time=`) {
+		t.Errorf("unexpected line: %s", line)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	file, err := openRotating(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		file.Write([]byte(line))
+	}
+	for suffix, expected := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		if content, _ := ioutil.ReadFile(path + suffix); string(content) != expected {
+			t.Errorf("expected %q in %s, got %q", expected, path+suffix, content)
+		}
+	}
+
+	// a backup that cannot be removed fails the rotation but not the writes
+	path = filepath.Join(dir, "stuck.log")
+	if err := os.MkdirAll(filepath.Join(path+".1", "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if file, err = openRotating(path, 10, 1); err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("first\n"))
+	if n, err := file.Write([]byte("second\n")); err == nil || n != 7 {
+		t.Errorf("expected failed rotation to be reported after writing, got %d %v", n, err)
+	}
+	file.Write([]byte("third\n"))
+	if content, _ := ioutil.ReadFile(path); string(content) != "first\nsecond\nthird\n" {
+		t.Errorf("expected writes to continue after a failed rotation, got %q", content)
+	}
+}
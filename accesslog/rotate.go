@@ -0,0 +1,80 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile appends to a file, renaming it to path.1 (shifting older
+// backups up to maxBackups) once it would grow beyond maxSize bytes.
+type rotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotating(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+// Write appends p, a failed rotation is reported after p was still appended
+// to the current file so that no line is lost.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	var rotateErr error
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		rotateErr = rf.rotate()
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate moves the file out of the way and opens a new one, the path is
+// reopened whatever step fails so writing can go on.
+func (rf *rotatingFile) rotate() (err error) {
+	rf.file.Close()
+	defer func() {
+		if openErr := rf.open(); err == nil {
+			err = openErr
+		}
+	}()
+	if rf.maxBackups == 0 {
+		return os.Remove(rf.path)
+	}
+	if err := os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(rf.path, rf.path+".1")
+}
@@ -0,0 +1,33 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+const Prefix = "/_admin"
+
+var mux = http.NewServeMux()
+
+// HandleFunc registers an admin endpoint below /_admin, the endpoints are
+// served by every listener configured with an admin token.
+func HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	mux.HandleFunc(Prefix+pattern, handler)
+}
+
+// Handler serves the registered admin endpoints to requests presenting the
+// token either as a bearer token or in the X-Admin-Token header.
+func Handler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented := r.Header.Get("X-Admin-Token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			presented = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -3,6 +3,8 @@ package cache
 import(
 	"github.com/creamdog/aproxy/cache/memcached"
 	"github.com/creamdog/aproxy/cache/elasticache"
+	"github.com/creamdog/aproxy/cache/memory"
+	"github.com/creamdog/aproxy/cache/redis"
 	"fmt"
 )
 
@@ -13,6 +15,12 @@ type CacheClient interface {
 	FlushAll() error
 }
 
+// Counter is implemented by cache clients able to increment a counter
+// atomically, the counter starts at zero and expires after expiration seconds.
+type Counter interface {
+	Increment(key string, expiration int) (int64, error)
+}
+
 
 func Get(config map[string]interface{}) (CacheClient, error) {
 	if t, exists := config["type"].(string); exists {
@@ -21,6 +29,12 @@ func Get(config map[string]interface{}) (CacheClient, error) {
 				return memcached.Init(config)
 			case "elasticache" :
 				return elasticache.Init(config)
+			case "redis" :
+				return redis.Init(config)
+			case "memory" :
+				return memory.Init(config)
+			case "tiered" :
+				return InitTiered(config)
 			default:
 				return nil, fmt.Errorf("unsupported cache type: %s", t)
 		}	
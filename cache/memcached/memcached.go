@@ -2,7 +2,7 @@ package memcached
 
 import(
 	"github.com/bradfitz/gomemcache/memcache"
-	"log"
+	"github.com/creamdog/aproxy/log"
 	"encoding/json"
 	"fmt"
 	"crypto/sha256"
@@ -14,7 +14,7 @@ type MemcachedClient struct {
 }
 
 func Init(config map[string]interface{}) (*MemcachedClient, error) {
-	log.Printf("initializing memcached client: %v", config)
+	log.Infof("initializing memcached client: %v", config)
 
 	hosts := []string{}
 	if values, exists := config["hosts"].([]interface{}); !exists {
@@ -72,9 +72,23 @@ func (mc *MemcachedClient) Set(key string, expiration int, v interface{}) error
 }
 
 func (mc *MemcachedClient) Delete(key string) error {
-	return mc.client.Delete(Sha256Key(key))
+	if err := mc.client.Delete(Sha256Key(key)); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// Increment adds one to the counter at key, adding it first when missing.
+func (mc *MemcachedClient) Increment(key string, expiration int) (int64, error) {
+	hashed := Sha256Key(key)
+	err := mc.client.Add(&memcache.Item{Key: hashed, Value: []byte("0"), Expiration: int32(expiration)})
+	if err != nil && err != memcache.ErrNotStored {
+		return 0, err
+	}
+	value, err := mc.client.Increment(hashed, 1)
+	return int64(value), err
 }
 
 func (mc *MemcachedClient) FlushAll() error {
-	return nil
+	return mc.client.FlushAll()
 }
\ No newline at end of file
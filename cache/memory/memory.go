@@ -0,0 +1,170 @@
+package memory
+
+import (
+	"container/list"
+	"encoding/json"
+	"github.com/creamdog/aproxy/log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxSize = 64 * 1024 * 1024
+	// expirations beyond 30 days are unix timestamps, as with memcached
+	maxRelativeExpiration = 60 * 60 * 24 * 30
+)
+
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func (e *entry) size() int {
+	return len(e.key) + len(e.value)
+}
+
+// MemoryClient is an in-process cache evicting the least recently used
+// entries once the stored keys and values exceed MaxSize bytes.
+type MemoryClient struct {
+	MaxSize int
+	size    int
+	lock    sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func Init(config map[string]interface{}) (*MemoryClient, error) {
+	log.Infof("initializing memory cache client: %v", config)
+	maxSize := defaultMaxSize
+	if value, ok := config["max_size_bytes"].(float64); ok {
+		maxSize = int(value)
+	}
+	return New(maxSize), nil
+}
+
+func New(maxSize int) *MemoryClient {
+	return &MemoryClient{
+		MaxSize: maxSize,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func expiresAt(expiration int) time.Time {
+	if expiration <= 0 {
+		return time.Time{}
+	} else if expiration > maxRelativeExpiration {
+		return time.Unix(int64(expiration), 0)
+	}
+	return time.Now().Add(time.Duration(expiration) * time.Second)
+}
+
+func (mc *MemoryClient) Get(key string, v interface{}) (bool, error) {
+	mc.lock.Lock()
+	element, exists := mc.entries[key]
+	if !exists {
+		mc.lock.Unlock()
+		return false, nil
+	}
+	e := element.Value.(*entry)
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		mc.remove(element)
+		mc.lock.Unlock()
+		return false, nil
+	}
+	mc.order.MoveToFront(element)
+	value := e.value
+	mc.lock.Unlock()
+
+	if v != nil {
+		if err := json.Unmarshal(value, v); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (mc *MemoryClient) Set(key string, expiration int, v interface{}) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e := &entry{key: key, value: bytes, expires: expiresAt(expiration)}
+	if e.size() > mc.MaxSize {
+		// entries too large to keep are dropped, never the previous value
+		// served in their place
+		return mc.Delete(key)
+	}
+
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if element, exists := mc.entries[key]; exists {
+		mc.remove(element)
+	}
+	mc.entries[key] = mc.order.PushFront(e)
+	mc.size += e.size()
+	for mc.size > mc.MaxSize {
+		mc.remove(mc.order.Back())
+	}
+	return nil
+}
+
+func (mc *MemoryClient) Delete(key string) error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	if element, exists := mc.entries[key]; exists {
+		mc.remove(element)
+	}
+	return nil
+}
+
+// Increment adds one to the counter stored at key, an expired or unset
+// counter starts over from zero and expires after expiration seconds.
+func (mc *MemoryClient) Increment(key string, expiration int) (int64, error) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	var value int64
+	expires := expiresAt(expiration)
+	if element, exists := mc.entries[key]; exists {
+		e := element.Value.(*entry)
+		if e.expires.IsZero() || time.Now().Before(e.expires) {
+			if current, err := strconv.ParseInt(string(e.value), 10, 64); err == nil {
+				value = current
+				expires = e.expires
+			}
+		}
+		mc.remove(element)
+	}
+	value++
+	e := &entry{key: key, value: []byte(strconv.FormatInt(value, 10)), expires: expires}
+	mc.entries[key] = mc.order.PushFront(e)
+	mc.size += e.size()
+	for mc.size > mc.MaxSize && mc.order.Len() > 1 {
+		mc.remove(mc.order.Back())
+	}
+	return value, nil
+}
+
+func (mc *MemoryClient) FlushAll() error {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	mc.order.Init()
+	mc.entries = map[string]*list.Element{}
+	mc.size = 0
+	return nil
+}
+
+// Size returns the number of bytes held by the cached keys and values.
+func (mc *MemoryClient) Size() int {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.size
+}
+
+func (mc *MemoryClient) remove(element *list.Element) {
+	e := mc.order.Remove(element).(*entry)
+	delete(mc.entries, e.key)
+	mc.size -= e.size()
+}
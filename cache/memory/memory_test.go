@@ -0,0 +1,55 @@
+package memory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEviction(t *testing.T) {
+	mc := New(30)
+	mc.Set("a", 0, "aaaaaaaa")
+	mc.Set("b", 0, "bbbbbbbb")
+	mc.Get("a", nil)
+	mc.Set("c", 0, "cccccccc")
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		if ok, _ := mc.Get(key, nil); ok != expected {
+			t.Errorf("%s: expected %v, got %v", key, expected, ok)
+		}
+	}
+	if mc.Size() > 30 {
+		t.Errorf("size exceeded: %d", mc.Size())
+	}
+
+	mc.Set("c", 0, "cccccccccccccccccccccccccccccc")
+	if ok, _ := mc.Get("c", nil); ok {
+		t.Errorf("expected oversized write to drop the previous value")
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	mc := New(1024)
+	mc.Set("relative", 1, "value")
+	mc.Set("absolute", int(time.Now().Unix())-1, "value")
+
+	var value string
+	if ok, err := mc.Get("relative", &value); !ok || err != nil || value != "value" {
+		t.Errorf("expected value, got %v %v %q", ok, err, value)
+	}
+	if ok, _ := mc.Get("absolute", nil); ok {
+		t.Errorf("expected absolute expiration in the past to miss")
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	mc := New(1024)
+	for expected := int64(1); expected <= 3; expected++ {
+		if value, err := mc.Increment("counter", 60); err != nil || value != expected {
+			t.Errorf("expected %d, got %d %v", expected, value, err)
+		}
+	}
+	mc.Set("counter", int(time.Now().Unix())-1, 10)
+	if value, _ := mc.Increment("counter", 60); value != 1 {
+		t.Errorf("expected expired counter to start over, got %d", value)
+	}
+}
@@ -0,0 +1,305 @@
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/creamdog/aproxy/log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPrefix  = "aproxy:"
+	defaultTimeout = 1 * time.Second
+	maxIdle        = 16
+	// expirations beyond 30 days are unix timestamps, as with memcached
+	maxRelativeExpiration = 60 * 60 * 24 * 30
+)
+
+type RedisClient struct {
+	Prefix     string
+	address    string
+	sentinels  []string
+	masterName string
+	password   string
+	db         int
+	timeout    time.Duration
+	lock       sync.Mutex
+	idle       []*conn
+}
+
+func Init(config map[string]interface{}) (*RedisClient, error) {
+	log.Infof("initializing redis client: %v", config)
+
+	c := &RedisClient{
+		Prefix:  defaultPrefix,
+		timeout: defaultTimeout,
+	}
+	if address, exists := config["address"].(string); exists {
+		c.address = address
+	}
+	if values, exists := config["sentinels"].([]interface{}); exists {
+		for _, v := range values {
+			c.sentinels = append(c.sentinels, v.(string))
+		}
+		if c.masterName, _ = config["master_name"].(string); len(c.masterName) == 0 {
+			return nil, fmt.Errorf("no master_name specified for redis sentinels")
+		}
+	}
+	if len(c.address) == 0 && len(c.sentinels) == 0 {
+		return nil, fmt.Errorf("no address or sentinels specified for redis client")
+	}
+	if prefix, exists := config["prefix"].(string); exists {
+		c.Prefix = prefix
+	}
+	if password, exists := config["password"].(string); exists {
+		c.password = password
+	}
+	if db, exists := config["db"].(float64); exists {
+		c.db = int(db)
+	}
+	if timeout, exists := config["timeout_ms"].(float64); exists {
+		c.timeout = time.Duration(timeout) * time.Millisecond
+	}
+
+	if _, err := c.do([]string{"PING"}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// master asks the sentinels for the address of the current master.
+func (c *RedisClient) master() (string, error) {
+	var lastErr error
+	for _, sentinel := range c.sentinels {
+		conn, err := dial(sentinel, c.timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		replies, err := conn.do([]string{"SENTINEL", "get-master-addr-by-name", c.masterName})
+		conn.close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if addr, ok := replies[0].([]interface{}); ok && len(addr) == 2 {
+			return net.JoinHostPort(string(addr[0].([]byte)), string(addr[1].([]byte))), nil
+		}
+		lastErr = fmt.Errorf("redis: sentinel %s does not know master %s", sentinel, c.masterName)
+	}
+	return "", lastErr
+}
+
+func (c *RedisClient) connect() (*conn, error) {
+	address := c.address
+	if len(c.sentinels) > 0 {
+		var err error
+		if address, err = c.master(); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := dial(address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	setup := [][]string{}
+	if len(c.password) > 0 {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		replies, err := conn.do(setup...)
+		if err == nil {
+			err = replyError(replies)
+		}
+		if err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// do runs the commands on a pooled connection. When the server is no longer
+// the master the pool is dropped and the commands are sent once more on a new
+// connection, which asks the sentinels for the current master.
+func (c *RedisClient) do(commands ...[]string) ([]interface{}, error) {
+	replies, err := c.try(commands...)
+	if failover(err) {
+		log.Warnf("redis: %v, reconnecting", err)
+		replies, err = c.try(commands...)
+	}
+	return replies, err
+}
+
+// failover reports whether err comes from a server that is not, or not yet,
+// able to act as the master.
+func failover(err error) bool {
+	if err, ok := err.(redisError); ok {
+		for _, prefix := range []string{"READONLY", "LOADING", "MASTERDOWN"} {
+			if strings.HasPrefix(string(err), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// try runs the commands on a pooled connection, connections failing with
+// network errors are discarded.
+func (c *RedisClient) try(commands ...[]string) ([]interface{}, error) {
+	c.lock.Lock()
+	var conn *conn
+	if len(c.idle) > 0 {
+		conn = c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+	}
+	c.lock.Unlock()
+
+	if conn == nil {
+		var err error
+		if conn, err = c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := conn.do(commands...)
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	if err := replyError(replies); failover(err) {
+		conn.close()
+		c.reset()
+		return replies, err
+	}
+
+	c.lock.Lock()
+	if len(c.idle) < maxIdle {
+		c.idle = append(c.idle, conn)
+		conn = nil
+	}
+	c.lock.Unlock()
+	if conn != nil {
+		conn.close()
+	}
+	return replies, replyError(replies)
+}
+
+// reset closes the idle connections.
+func (c *RedisClient) reset() {
+	c.lock.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.lock.Unlock()
+	for _, conn := range idle {
+		conn.close()
+	}
+}
+
+func replyError(replies []interface{}) error {
+	for _, reply := range replies {
+		if err, isError := reply.(redisError); isError {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RedisClient) Get(key string, v interface{}) (bool, error) {
+	replies, err := c.do([]string{"GET", c.Prefix + key})
+	if err != nil {
+		return false, err
+	}
+	value, ok := replies[0].([]byte)
+	if !ok || value == nil {
+		return false, nil
+	}
+	if v != nil {
+		if err := json.Unmarshal(value, v); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (c *RedisClient) Set(key string, expiration int, v interface{}) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	command := []string{"SET", c.Prefix + key, string(bytes)}
+	if expiration > maxRelativeExpiration {
+		expiration -= int(time.Now().Unix())
+		if expiration <= 0 {
+			return c.Delete(key)
+		}
+	}
+	if expiration > 0 {
+		command = append(command, "EX", strconv.Itoa(expiration))
+	}
+	_, err = c.do(command)
+	return err
+}
+
+// incrementScript increments a counter and sets its expiration when the
+// increment created it, as a single atomic command.
+const incrementScript = `local value = redis.call("INCR", KEYS[1])
+if value == 1 and tonumber(ARGV[1]) > 0 then
+	redis.call("EXPIRE", KEYS[1], ARGV[1])
+end
+return value`
+
+// Increment adds one to the counter at key, the expiration is set by the
+// increment creating the counter.
+func (c *RedisClient) Increment(key string, expiration int) (int64, error) {
+	replies, err := c.do([]string{"EVAL", incrementScript, "1", c.Prefix + key, strconv.Itoa(expiration)})
+	if err != nil {
+		return 0, err
+	}
+	value, ok := replies[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected increment reply %v", replies[0])
+	}
+	return value, nil
+}
+
+func (c *RedisClient) Delete(key string) error {
+	_, err := c.do([]string{"DEL", c.Prefix + key})
+	return err
+}
+
+// FlushAll deletes every key carrying the client prefix.
+func (c *RedisClient) FlushAll() error {
+	cursor := "0"
+	for {
+		replies, err := c.do([]string{"SCAN", cursor, "MATCH", c.Prefix + "*", "COUNT", "100"})
+		if err != nil {
+			return err
+		}
+		reply, ok := replies[0].([]interface{})
+		if !ok || len(reply) != 2 {
+			return fmt.Errorf("redis: unexpected scan reply %v", replies[0])
+		}
+		cursor = string(reply[0].([]byte))
+		if keys, _ := reply[1].([]interface{}); len(keys) > 0 {
+			command := []string{"DEL"}
+			for _, key := range keys {
+				command = append(command, string(key.([]byte)))
+			}
+			if _, err := c.do(command); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeServer implements the handful of commands used by RedisClient.
+type fakeServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	values   map[string]string
+	ttls     map[string]int
+	master   string
+	// readonly servers answer writes like a demoted master
+	readonly bool
+}
+
+func startFake(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeServer{listener: listener, values: map[string]string{}, ttls: map[string]int{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fs.serve(conn)
+		}
+	}()
+	return fs
+}
+
+func (fs *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		fmt.Fprint(conn, fs.handle(args))
+	}
+}
+
+func bulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func (fs *fakeServer) handle(args []string) string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	command := strings.ToUpper(args[0])
+	if fs.readonly && (command == "SET" || command == "DEL" || command == "EXPIRE" || command == "EVAL") {
+		return "-READONLY You can't write against a read only replica.\r\n"
+	}
+	switch command {
+	case "PING":
+		return "+PONG\r\n"
+	case "SET":
+		fs.values[args[1]] = args[2]
+		if len(args) == 5 && strings.ToUpper(args[3]) == "EX" {
+			fs.ttls[args[1]], _ = strconv.Atoi(args[4])
+		}
+		return "+OK\r\n"
+	case "GET":
+		if value, exists := fs.values[args[1]]; exists {
+			return bulk(value)
+		}
+		return "$-1\r\n"
+	case "EVAL":
+		// the increment script of RedisClient.Increment
+		value, _ := strconv.Atoi(fs.values[args[3]])
+		fs.values[args[3]] = strconv.Itoa(value + 1)
+		if value == 0 {
+			fs.ttls[args[3]], _ = strconv.Atoi(args[4])
+		}
+		return fmt.Sprintf(":%d\r\n", value+1)
+	case "EXPIRE":
+		fs.ttls[args[1]], _ = strconv.Atoi(args[2])
+		return ":1\r\n"
+	case "DEL":
+		for _, key := range args[1:] {
+			delete(fs.values, key)
+		}
+		return fmt.Sprintf(":%d\r\n", len(args)-1)
+	case "SCAN":
+		prefix := strings.TrimSuffix(args[3], "*")
+		keys := ""
+		count := 0
+		for key := range fs.values {
+			if strings.HasPrefix(key, prefix) {
+				keys += bulk(key)
+				count++
+			}
+		}
+		return "*2\r\n" + bulk("0") + fmt.Sprintf("*%d\r\n", count) + keys
+	case "SENTINEL":
+		host, port, _ := net.SplitHostPort(fs.master)
+		return "*2\r\n" + bulk(host) + bulk(port)
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisClient(t *testing.T) {
+	fs := startFake(t)
+	defer fs.listener.Close()
+
+	c, err := Init(map[string]interface{}{"address": fs.listener.Addr().String(), "prefix": "test:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Set("a", 30, map[string]string{"hello": "world"}); err != nil {
+		t.Fatal(err)
+	}
+	var value map[string]string
+	if ok, err := c.Get("a", &value); !ok || err != nil || value["hello"] != "world" {
+		t.Errorf("unexpected get: %v %v %v", ok, err, value)
+	}
+	if fs.ttls["test:a"] != 30 {
+		t.Errorf("expected ttl to be set, got %v", fs.ttls)
+	}
+	if ok, _ := c.Get("missing", nil); ok {
+		t.Errorf("expected miss")
+	}
+
+	for expected := int64(1); expected <= 2; expected++ {
+		if value, err := c.Increment("counter", 60); err != nil || value != expected {
+			t.Errorf("expected counter %d, got %d %v", expected, value, err)
+		}
+	}
+	if fs.ttls["test:counter"] != 60 {
+		t.Errorf("expected counter ttl to be set, got %v", fs.ttls)
+	}
+
+	fs.values["other:b"] = "1"
+	c.Set("b", 0, "b")
+	if err := c.FlushAll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.values) != 1 || fs.values["other:b"] != "1" {
+		t.Errorf("expected flush scoped to prefix, got %v", fs.values)
+	}
+}
+
+func TestSentinel(t *testing.T) {
+	master := startFake(t)
+	defer master.listener.Close()
+	sentinel := startFake(t)
+	defer sentinel.listener.Close()
+	sentinel.master = master.listener.Addr().String()
+
+	c, err := Init(map[string]interface{}{
+		"sentinels":   []interface{}{"127.0.0.1:1", sentinel.listener.Addr().String()},
+		"master_name": "mymaster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("a", 0, "a")
+	if _, exists := master.values[defaultPrefix+"a"]; !exists {
+		t.Errorf("expected value on master, got %v", master.values)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	demoted := startFake(t)
+	defer demoted.listener.Close()
+	promoted := startFake(t)
+	defer promoted.listener.Close()
+	sentinel := startFake(t)
+	defer sentinel.listener.Close()
+	sentinel.master = demoted.listener.Addr().String()
+
+	c, err := Init(map[string]interface{}{
+		"sentinels":   []interface{}{sentinel.listener.Addr().String()},
+		"master_name": "mymaster",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("a", 0, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	demoted.lock.Lock()
+	demoted.readonly = true
+	demoted.lock.Unlock()
+	sentinel.lock.Lock()
+	sentinel.master = promoted.listener.Addr().String()
+	sentinel.lock.Unlock()
+
+	if err := c.Set("b", 0, "b"); err != nil {
+		t.Fatalf("expected write to reach the promoted master, got %v", err)
+	}
+	promoted.lock.Lock()
+	defer promoted.lock.Unlock()
+	if _, exists := promoted.values[defaultPrefix+"b"]; !exists {
+		t.Errorf("expected value on promoted master, got %v", promoted.values)
+	}
+}
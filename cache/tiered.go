@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/creamdog/aproxy/cache/memory"
+	"github.com/creamdog/aproxy/log"
+	"time"
+)
+
+// expirations beyond 30 days are unix timestamps, as with memcached
+const maxRelativeExpiration = 60 * 60 * 24 * 30
+
+// TieredClient layers an in-process cache in front of a shared backend,
+// reads fall through to the backend and populate the memory tier, writes go
+// to both tiers.
+type TieredClient struct {
+	Memory  *memory.MemoryClient
+	Backend CacheClient
+	// Seconds bounds how long entries stay in memory, entries never outlive
+	// their own expiration
+	Seconds int
+}
+
+// tieredEntry is stored in the backend so that entries read from it keep
+// their expiration in the memory tier.
+type tieredEntry struct {
+	Expires int64           `json:"expires,omitempty"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// expiresAt returns the unix time of an expiration, 0 when it never expires.
+func expiresAt(expiration int) int64 {
+	if expiration <= 0 {
+		return 0
+	} else if expiration > maxRelativeExpiration {
+		return int64(expiration)
+	}
+	return time.Now().Unix() + int64(expiration)
+}
+
+func InitTiered(config map[string]interface{}) (*TieredClient, error) {
+	log.Infof("initializing tiered cache client: %v", config)
+	backendConfig, exists := config["backend"].(map[string]interface{})
+	if !exists {
+		return nil, fmt.Errorf("no backend specified for tiered cache client")
+	}
+	backend, err := Get(backendConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	memoryConfig, _ := config["memory"].(map[string]interface{})
+	if memoryConfig == nil {
+		memoryConfig = map[string]interface{}{}
+	}
+	mc, err := memory.Init(memoryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	seconds := 10
+	if value, ok := config["ttl_seconds"].(float64); ok {
+		seconds = int(value)
+	} else if value, ok := memoryConfig["ttl_seconds"].(float64); ok {
+		seconds = int(value)
+	}
+	return &TieredClient{Memory: mc, Backend: backend, Seconds: seconds}, nil
+}
+
+func (tc *TieredClient) Get(key string, v interface{}) (bool, error) {
+	if ok, err := tc.Memory.Get(key, v); ok || err != nil {
+		return ok, err
+	}
+	var entry tieredEntry
+	ok, err := tc.Backend.Get(key, &entry)
+	if !ok || err != nil || entry.Value == nil {
+		return false, err
+	}
+	if v != nil {
+		if err := json.Unmarshal(entry.Value, v); err != nil {
+			return false, err
+		}
+	}
+	tc.remember(key, entry.Expires, entry.Value)
+	return true, nil
+}
+
+func (tc *TieredClient) Set(key string, expiration int, v interface{}) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	expires := expiresAt(expiration)
+	tc.remember(key, expires, bytes)
+	return tc.Backend.Set(key, expiration, tieredEntry{Expires: expires, Value: bytes})
+}
+
+// remember keeps value in memory for Seconds, or until expires if sooner.
+func (tc *TieredClient) remember(key string, expires int64, value json.RawMessage) {
+	limit := time.Now().Unix() + int64(tc.Seconds)
+	if expires == 0 || expires > limit {
+		expires = limit
+	}
+	if tc.Seconds <= 0 || expires <= time.Now().Unix() {
+		tc.Memory.Delete(key)
+		return
+	}
+	tc.Memory.Set(key, int(expires), value)
+}
+
+func (tc *TieredClient) Delete(key string) error {
+	tc.Memory.Delete(key)
+	return tc.Backend.Delete(key)
+}
+
+// Increment counts in the backend when it is a Counter, otherwise in memory.
+func (tc *TieredClient) Increment(key string, expiration int) (int64, error) {
+	if counter, ok := tc.Backend.(Counter); ok {
+		return counter.Increment(key, expiration)
+	}
+	return tc.Memory.Increment(key, expiration)
+}
+
+func (tc *TieredClient) FlushAll() error {
+	tc.Memory.FlushAll()
+	return tc.Backend.FlushAll()
+}
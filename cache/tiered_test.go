@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"github.com/creamdog/aproxy/cache/memory"
+	"testing"
+	"time"
+)
+
+func TestTieredExpiration(t *testing.T) {
+	backend := memory.New(1024)
+	tc := &TieredClient{Memory: memory.New(1024), Backend: backend, Seconds: 60}
+
+	tc.Set("short", 1, "value")
+	tc.Set("long", 0, "value")
+	if ok, _ := tc.Memory.Get("short", nil); !ok {
+		t.Errorf("expected short entry in memory")
+	}
+	tc.Memory.FlushAll()
+	var value string
+	if ok, err := tc.Get("short", &value); !ok || err != nil || value != "value" {
+		t.Errorf("expected short entry from backend, got %v %v %q", ok, err, value)
+	}
+	tc.Get("long", nil)
+
+	time.Sleep(1100 * time.Millisecond)
+	if ok, _ := tc.Memory.Get("short", nil); ok {
+		t.Errorf("expected memory tier to honor the entry expiration")
+	}
+	if ok, _ := tc.Memory.Get("long", nil); !ok {
+		t.Errorf("expected long entry to stay in memory")
+	}
+
+	tc.Seconds = 0
+	tc.Memory.FlushAll()
+	if ok, _ := tc.Get("long", nil); !ok {
+		t.Errorf("expected long entry from backend")
+	}
+	if ok, _ := tc.Memory.Get("long", nil); ok {
+		t.Errorf("expected ttl_seconds 0 to bypass the memory tier")
+	}
+}
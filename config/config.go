@@ -11,6 +11,11 @@ type Config struct {
 	Mappings    map[string]interface{}   `json:"mappings"`
 	MappingRepo map[string]interface{}   `json:"mapping"`
 	Cache 		map[string]interface{}   `json:"cache"`
+	Upstreams   map[string]interface{}   `json:"upstreams"`
+	Log         map[string]interface{}   `json:"log"`
+	Tracing     map[string]interface{}   `json:"tracing"`
+
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"`
 }
 
 func Load(filename string) (*Config, error) {
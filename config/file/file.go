@@ -2,30 +2,56 @@ package file
 
 import (
 	"encoding/json"
+	"github.com/creamdog/aproxy/health"
+	"github.com/creamdog/aproxy/log"
 	"github.com/creamdog/aproxy/mappings"
 	"io/ioutil"
-	"log"
 	"path"
 	"sync"
 	"time"
 )
 
 type Listener struct {
-	Seen    map[string]time.Time
-	Lock    *sync.Mutex
-	Mapping *mappings.Mappings
-	Path    string
+	Seen     map[string]time.Time
+	Lock     *sync.Mutex
+	Mapping  *mappings.Mappings
+	Path     string
+	LastPoll time.Time
+	stop     chan bool
+	once     sync.Once
 }
 
-func Start(mapping *mappings.Mappings, path string) {
-	l := &Listener{make(map[string]time.Time, 0), &sync.Mutex{}, mapping, path}
+func Start(mapping *mappings.Mappings, path string) *Listener {
+	l := &Listener{Seen: make(map[string]time.Time, 0), Lock: &sync.Mutex{}, Mapping: mapping, Path: path, stop: make(chan bool)}
+	health.Register("mapping_repo", false, l.status)
 	go l.poll()
+	return l
+}
+
+// Stop ends polling for mapping files.
+func (listener *Listener) Stop() {
+	listener.once.Do(func() {
+		close(listener.stop)
+	})
+}
+
+func (listener *Listener) status() (interface{}, error) {
+	listener.Lock.Lock()
+	defer listener.Lock.Unlock()
+	return map[string]interface{}{
+		"type":      "file",
+		"path":      listener.Path,
+		"last_poll": listener.LastPoll.Format(time.RFC3339),
+		"files":     len(listener.Seen),
+	}, nil
 }
 
 func (listener *Listener) poll() {
 	for {
-		log.Printf("polling %v", listener.Path)
+		log.Debugf("polling %v", listener.Path)
 		files, _ := ioutil.ReadDir(listener.Path)
+		changed := []string{}
+		listener.Lock.Lock()
 		for _, f := range files {
 			fpath := path.Join(listener.Path, f.Name())
 			if f.IsDir() {
@@ -35,22 +61,44 @@ func (listener *Listener) poll() {
 				continue
 			}
 			listener.Seen[fpath] = f.ModTime()
+			changed = append(changed, fpath)
+		}
+		listener.Lock.Unlock()
+		// files are loaded without the lock so the status check never waits
+		// on mappings being registered
+		for _, fpath := range changed {
 			listener.loadFile(fpath)
 		}
-		time.Sleep(1 * time.Second)
+		listener.Lock.Lock()
+		listener.LastPoll = time.Now()
+		listener.Lock.Unlock()
+		select {
+		case <-listener.stop:
+			log.Infof("stopped polling %v", listener.Path)
+			return
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
 
 func (listener *Listener) loadFile(filename string) {
-	log.Printf("loading file %v", filename)
+	log.Infof("loading file %v", filename)
 	if bytes, err := ioutil.ReadFile(filename); err != nil {
-		return
+		log.Errorf("%s => %v", filename, err)
+		mappings.Reloads.Inc("file", "error")
 	} else {
 		var config map[string]interface{}
 		if err = json.Unmarshal(bytes, &config); err != nil {
-			return
+			log.Errorf("%s => %v", filename, err)
+			mappings.Reloads.Inc("file", "error")
+		} else if section, ok := config["mappings"].(map[string]interface{}); !ok {
+			log.Errorf("%s => no mappings section", filename)
+			mappings.Reloads.Inc("file", "error")
+		} else if _, err := listener.Mapping.Register(section); err != nil {
+			log.Errorf("%s => %v", filename, err)
+			mappings.Reloads.Inc("file", "error")
 		} else {
-			listener.Mapping.Register(config["mappings"].(map[string]interface{}))
+			mappings.Reloads.Inc("file", "success")
 		}
 	}
 }
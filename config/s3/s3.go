@@ -2,25 +2,35 @@ package s3
 
 import (
 	"encoding/json"
+	"github.com/creamdog/aproxy/health"
+	"github.com/creamdog/aproxy/log"
 	"github.com/creamdog/aproxy/mappings"
 	"github.com/crowdmob/goamz/aws"
 	"github.com/crowdmob/goamz/s3"
 	"github.com/frontierpsycho/paradoxutil/s3poller"
-	"log"
 	"strings"
+	"sync"
+	"time"
 )
 
 type FilesStatus struct {
 	Mappings         *mappings.Mappings
 	FileToMappingIds map[string][]string
+	Started          time.Time
+	LastChange       time.Time
+	Lock             *sync.Mutex
+	stopped          bool
 }
 
-func Start(mapping *mappings.Mappings, config map[string]interface{}) {
+// Start polls the configured bucket for mapping files, the returned function
+// stops applying changes found by the poller.
+func Start(mapping *mappings.Mappings, config map[string]interface{}) func() {
 	auth := &aws.Auth{AccessKey: config["access_key"].(string), SecretKey: config["secret_key"].(string)}
 	s3Client := s3.New(*auth, aws.GetRegion(config["region"].(string)))
 	bucket := s3Client.Bucket(config["bucket"].(string))
 
-	filesStatus := FilesStatus{mapping, make(map[string][]string)}
+	filesStatus := &FilesStatus{Mappings: mapping, FileToMappingIds: make(map[string][]string), Started: time.Now(), Lock: &sync.Mutex{}}
+	health.Register("mapping_repo", false, filesStatus.status)
 
 	poller := s3poller.S3Poller{
 		auth,
@@ -33,26 +43,63 @@ func Start(mapping *mappings.Mappings, config map[string]interface{}) {
 	}
 
 	go poller.poll()
+	return filesStatus.stop
+}
+
+// stop makes the handlers ignore further changes, the poller itself offers
+// no way to be stopped.
+func (fs *FilesStatus) stop() {
+	fs.Lock.Lock()
+	defer fs.Lock.Unlock()
+	fs.stopped = true
+}
+
+func (fs *FilesStatus) isStopped() bool {
+	fs.Lock.Lock()
+	defer fs.Lock.Unlock()
+	return fs.stopped
+}
+
+func (fs *FilesStatus) status() (interface{}, error) {
+	fs.Lock.Lock()
+	defer fs.Lock.Unlock()
+	status := map[string]interface{}{
+		"type":    "s3",
+		"started": fs.Started.Format(time.RFC3339),
+		"files":   len(fs.FileToMappingIds),
+	}
+	if !fs.LastChange.IsZero() {
+		status["last_change"] = fs.LastChange.Format(time.RFC3339)
+	}
+	return status, nil
 }
 
 func (fs *FilesStatus) makeAdditionHandler() func([]byte, s3.Key) error {
 	return func(data []byte, content s3.Key) error {
+		if fs.isStopped() {
+			return nil
+		}
 		dconf := map[string]interface{}{}
 		if err := json.Unmarshal(data, &dconf); err != nil {
-			log.Printf("%s => %q", content.Key, err)
+			log.Errorf("%s => %v", content.Key, err)
+			mappings.Reloads.Inc("s3", "error")
 			return err
 		}
 		dconf = ConfigMap(dconf).LowerCaseKeys()
 
-		log.Printf(string(data))
-		log.Printf("%q", dconf)
+		log.Debugf("%s => %s", content.Key, data)
 
 		if ids, err := fs.Mappings.Register(dconf["mappings"].(map[string]interface{})); err != nil {
-			log.Printf("%q", err)
+			log.Errorf("%s => %v", content.Key, err)
+			mappings.Reloads.Inc("s3", "error")
 			return err
 		} else {
+			fs.Lock.Lock()
 			fs.FileToMappingIds[content.Key] = ids
-			log.Printf("%s => registered ids %q", content.Key, fs.FileToMappingIds[content.Key])
+			fs.LastChange = time.Now()
+			fs.Lock.Unlock()
+			mappings.Reloads.Inc("s3", "success")
+			log.Infof("%s => registered ids %q", content.Key, fs.FileToMappingIds[content.Key])
 		}
 
 		return nil
@@ -61,7 +108,14 @@ func (fs *FilesStatus) makeAdditionHandler() func([]byte, s3.Key) error {
 
 func (fs *FilesStatus) makeRemovalHandler() func(string) error {
 	return func(key string) error {
+		fs.Lock.Lock()
+		defer fs.Lock.Unlock()
+		if fs.stopped {
+			return nil
+		}
 		fs.Mappings.DeRegister(fs.FileToMappingIds[key])
+		delete(fs.FileToMappingIds, key)
+		fs.LastChange = time.Now()
 		return nil
 	}
 }
@@ -0,0 +1,131 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type check struct {
+	critical bool
+	run      func() (interface{}, error)
+}
+
+var lock = &sync.RWMutex{}
+var checks = map[string]*check{}
+
+// Register adds a check to the status report, run is evaluated on every
+// status request and must be cheap. A failing critical check makes the
+// service report itself unavailable.
+func Register(name string, critical bool, run func() (interface{}, error)) {
+	lock.Lock()
+	defer lock.Unlock()
+	checks[name] = &check{critical: critical, run: run}
+}
+
+// Unregister removes a check from the status report.
+func Unregister(name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(checks, name)
+}
+
+// Probe runs probe in the background every interval and registers a check
+// reporting its latest outcome, it returns a function stopping the probe
+// and removing the check.
+func Probe(name string, critical bool, interval time.Duration, probe func() (interface{}, error)) func() {
+	var mutex sync.Mutex
+	var lastDetails interface{}
+	var lastErr error
+	var checked time.Time
+	run := func() {
+		details, err := probe()
+		mutex.Lock()
+		lastDetails, lastErr, checked = details, err, time.Now()
+		mutex.Unlock()
+	}
+	run()
+
+	Register(name, critical, func() (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return map[string]interface{}{
+			"checked": checked.Format(time.RFC3339),
+			"probe":   lastDetails,
+		}, lastErr
+	})
+
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				run()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			Unregister(name)
+		})
+	}
+}
+
+// Report evaluates every check, it is healthy unless a critical check fails.
+func Report() (map[string]interface{}, bool) {
+	lock.RLock()
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	lock.RUnlock()
+	sort.Strings(names)
+
+	healthy := true
+	results := map[string]interface{}{}
+	for _, name := range names {
+		lock.RLock()
+		c := checks[name]
+		lock.RUnlock()
+		details, err := c.run()
+		result := map[string]interface{}{
+			"healthy":  err == nil,
+			"critical": c.critical,
+		}
+		if details != nil {
+			result["details"] = details
+		}
+		if err != nil {
+			result["error"] = err.Error()
+			if c.critical {
+				healthy = false
+			}
+		}
+		results[name] = result
+	}
+	return results, healthy
+}
+
+// Handler writes the status report as json, with status 503 when unhealthy.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	results, healthy := Report()
+	status, code := "ok", http.StatusOK
+	if !healthy {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": results,
+	})
+}
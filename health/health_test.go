@@ -0,0 +1,30 @@
+package health
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	Register("optional", false, func() (interface{}, error) {
+		return nil, errors.New("down")
+	})
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/_status", nil))
+	if w.Code != 200 {
+		t.Errorf("expected failing optional check to be tolerated, got %d", w.Code)
+	}
+
+	failing := errors.New("unreachable")
+	stop := Probe("critical", true, 10*time.Millisecond, func() (interface{}, error) {
+		return nil, failing
+	})
+	defer stop()
+	w = httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/_status", nil))
+	if w.Code != 503 {
+		t.Errorf("expected failing critical check to be reported, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -1,25 +1,58 @@
 package http
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"github.com/creamdog/aproxy/accesslog"
+	"github.com/creamdog/aproxy/admin"
+	"github.com/creamdog/aproxy/health"
+	"github.com/creamdog/aproxy/log"
+	"github.com/creamdog/aproxy/metrics"
+	"github.com/creamdog/aproxy/tracing"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 type HttpListener struct {
 	Interface string
 	UIPath    string
+	AdminToken string
+	AccessLog *accesslog.Logger
+	Limits    *Limits
 	Started   bool
 	Mux       *http.ServeMux
+	Server    *http.Server
+	TLS       *tls.Config
+	DisableHTTP2 bool
+	certs     *certStore
+	lock      sync.Mutex
 	OnData    func(map[string]interface{}, http.ResponseWriter)
 }
 
 func Init(config map[string]interface{}, ondata func(map[string]interface{}, http.ResponseWriter)) (*HttpListener, error) {
-	log.Printf("initialized http listener: %v", config)
+	log.Infof("initialized http listener: %v", config)
+	var accessLog *accesslog.Logger
+	if section, ok := config["access_log"].(map[string]interface{}); ok {
+		var err error
+		if accessLog, err = accesslog.New(section); err != nil {
+			return nil, err
+		}
+	}
+	limits, err := parseLimits(config)
+	if err != nil {
+		return nil, err
+	}
 	return &HttpListener{
 		Interface: config["interface"].(string),
 		UIPath:    config["ui"].(string),
+		AdminToken: strOrEmpty(config["admin_token"]),
+		AccessLog: accessLog,
+		Limits:    limits,
 		Started:   false,
 		OnData:    ondata,
 		Mux:       nil}, nil
@@ -35,11 +68,16 @@ func (listener *HttpListener) handle(w http.ResponseWriter, r *http.Request) {
 			"protocol":       r.Proto,
 			"uri":            r.RequestURI,
 			"content-length": fmt.Sprintf("%d", r.ContentLength),
+			"id":             r.Header.Get(RequestIdHeader),
+			"remote_addr":    remoteHost(r.RemoteAddr),
 			"body" : r.Body,
 		},
 		"query" :  map[string]interface{}{},
 		"header" : map[string]interface{}{},
 	}
+	if r.TLS != nil {
+		data["tls"] = tlsData(r.TLS)
+	}
 
 	for key, values := range r.URL.Query() {
 		if len(values) > 1 {
@@ -61,25 +99,118 @@ func (listener *HttpListener) handle(w http.ResponseWriter, r *http.Request) {
 func (listener *HttpListener) Start() {
 	listener.Mux = http.NewServeMux()
 	listener.Mux.Handle(listener.UIPath, http.StripPrefix(listener.UIPath, http.FileServer(http.Dir("http-files"))))
-	listener.Mux.HandleFunc("/", listener.handle)
-	listener.Mux.HandleFunc("/_status", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "ok")
-	})
+	listener.Mux.Handle("/", listener.Limits.limitInFlight(listener.Interface, http.HandlerFunc(listener.handle)))
+	listener.Mux.HandleFunc("/_status", health.Handler)
+	listener.Mux.HandleFunc("/_metrics", metrics.Handler)
+	if len(listener.AdminToken) > 0 {
+		listener.Mux.Handle(admin.Prefix+"/", admin.Handler(listener.AdminToken))
+	}
+	var handler http.Handler = requestIds(tracing.Wrap(listener.Mux))
+	if listener.AccessLog != nil {
+		handler = listener.AccessLog.Wrap(handler)
+	}
+	listener.Server = &http.Server{Addr: listener.Interface, Handler: handler, TLSConfig: listener.TLS}
+	listener.Limits.apply(listener.Server)
+	if listener.DisableHTTP2 {
+		listener.Server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	ln, err := net.Listen("tcp", listener.Interface)
+	if err != nil {
+		log.Errorf("listen %v: %v", listener.Interface, err)
+		return
+	}
+	ln = limitConnections(ln, listener.Limits.MaxConnections)
+	listener.lock.Lock()
+	listener.Started = true
+	listener.lock.Unlock()
 	go func() {
-		err := http.ListenAndServe(listener.Interface, listener.Mux)
-		if err != nil {
-			listener.Mux = nil
-			log.Fatal("ListenAndServe: ", err)
+		var err error
+		if listener.TLS != nil {
+			err = listener.Server.ServeTLS(ln, "", "")
+		} else {
+			err = listener.Server.Serve(ln)
 		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("serve %v: %v", listener.Interface, err)
+		}
+		listener.lock.Lock()
+		listener.Started = false
+		listener.lock.Unlock()
 	}()
-	listener.Started = true
-	log.Printf("started http listener %v\n", listener.Interface)
+	log.Infof("started http listener %v", listener.Interface)
 }
 
-func (listener *HttpListener) Stop() {
+// Stop closes the listening socket and waits for in-flight requests to
+// complete until ctx is done, remaining connections are then closed.
+func (listener *HttpListener) Stop(ctx context.Context) error {
+	if listener.Server == nil {
+		return nil
+	}
+	log.Infof("stopping http listener %v", listener.Interface)
+	if listener.certs != nil {
+		listener.certs.close()
+	}
+	err := listener.Server.Shutdown(ctx)
+	if err != nil {
+		listener.Server.Close()
+	}
+	listener.lock.Lock()
 	listener.Started = false
+	listener.lock.Unlock()
+	return err
 }
 
 func (listener *HttpListener) IsRunning() bool {
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
 	return listener.Started
 }
+
+const RequestIdHeader = "X-Request-Id"
+
+// requestIds keeps valid incoming request ids and generates one otherwise,
+// the id is echoed in the response.
+func requestIds(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if !validRequestId(id) {
+			id = newRequestId()
+			r.Header.Set(RequestIdHeader, id)
+		}
+		w.Header().Set(RequestIdHeader, id)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func validRequestId(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestId() string {
+	buffer := make([]byte, 16)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+// remoteHost strips the port from the remote address of a request.
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func strOrEmpty(v interface{}) string {
+	if str, ok := v.(string); ok {
+		return str
+	}
+	return ""
+}
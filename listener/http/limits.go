@@ -0,0 +1,134 @@
+package http
+
+import (
+	"fmt"
+	"github.com/creamdog/aproxy/metrics"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var rejectedRequests = metrics.NewCounter("aproxy_rejected_requests_total", "Requests rejected by the max_in_flight limit per listener.", "listener")
+
+// Limits protect a listener against slow and excessive clients.
+type Limits struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	MaxConnections    int
+	MaxInFlight       int
+	RetryAfter        int
+}
+
+func parseLimits(config map[string]interface{}) (*Limits, error) {
+	limits := &Limits{
+		ReadTimeout:       millis(config["read_timeout_ms"], 0),
+		ReadHeaderTimeout: millis(config["read_header_timeout_ms"], 10*time.Second),
+		WriteTimeout:      millis(config["write_timeout_ms"], 0),
+		IdleTimeout:       millis(config["idle_timeout_ms"], 120*time.Second),
+		MaxHeaderBytes:    intOrDefault(config["max_header_bytes"], http.DefaultMaxHeaderBytes),
+		MaxConnections:    intOrDefault(config["max_connections"], 0),
+		MaxInFlight:       intOrDefault(config["max_in_flight"], 0),
+		RetryAfter:        intOrDefault(config["retry_after_seconds"], 1),
+	}
+	if limits.MaxConnections < 0 || limits.MaxInFlight < 0 || limits.MaxHeaderBytes <= 0 {
+		return nil, fmt.Errorf("invalid listener limits: %v", config)
+	}
+	return limits, nil
+}
+
+// apply sets the timeouts and header limit of server.
+func (limits *Limits) apply(server *http.Server) {
+	server.ReadTimeout = limits.ReadTimeout
+	server.ReadHeaderTimeout = limits.ReadHeaderTimeout
+	server.WriteTimeout = limits.WriteTimeout
+	server.IdleTimeout = limits.IdleTimeout
+	server.MaxHeaderBytes = limits.MaxHeaderBytes
+}
+
+// limitInFlight answers 503 with a Retry-After header while MaxInFlight
+// requests are being handled.
+func (limits *Limits) limitInFlight(name string, handler http.Handler) http.Handler {
+	if limits.MaxInFlight <= 0 {
+		return handler
+	}
+	slots := make(chan bool, limits.MaxInFlight)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- true:
+			defer func() { <-slots }()
+			handler.ServeHTTP(w, r)
+		default:
+			rejectedRequests.Inc(name)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", limits.RetryAfter))
+			http.Error(w, "too many requests in flight", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// limitListener accepts at most max concurrent connections, further
+// connections wait in the accept backlog until one is closed.
+type limitListener struct {
+	net.Listener
+	slots  chan bool
+	closed chan bool
+	once   sync.Once
+}
+
+func limitConnections(l net.Listener, max int) net.Listener {
+	if max <= 0 {
+		return l
+	}
+	return &limitListener{Listener: l, slots: make(chan bool, max), closed: make(chan bool)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- true:
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+// Close closes the listener and releases an Accept waiting for a slot.
+func (l *limitListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+func millis(value interface{}, def time.Duration) time.Duration {
+	if ms, ok := value.(float64); ok {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return def
+}
+
+func intOrDefault(value interface{}, def int) int {
+	if i, ok := value.(float64); ok {
+		return int(i)
+	}
+	return def
+}
@@ -0,0 +1,251 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/creamdog/aproxy/log"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certStore holds the certificates served by an https listener, reloading
+// them whenever their files change on disk.
+type certStore struct {
+	certFile string
+	keyFile  string
+	certDir  string
+	lock     sync.RWMutex
+	certs    []*tls.Certificate
+	modTimes map[string]time.Time
+	stop     chan bool
+	once     sync.Once
+}
+
+// certPairs lists the certificate and key files of the store, a directory
+// holds <name>.crt files along with their <name>.key.
+func (cs *certStore) certPairs() ([][2]string, error) {
+	pairs := [][2]string{}
+	if len(cs.certFile) > 0 {
+		pairs = append(pairs, [2]string{cs.certFile, cs.keyFile})
+	}
+	if len(cs.certDir) > 0 {
+		certFiles, err := filepath.Glob(filepath.Join(cs.certDir, "*.crt"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(certFiles)
+		for _, certFile := range certFiles {
+			pairs = append(pairs, [2]string{certFile, strings.TrimSuffix(certFile, ".crt") + ".key"})
+		}
+	}
+	return pairs, nil
+}
+
+// load reads every certificate when a file was added, removed or modified
+// since the previous load, the previous certificates stay in use on errors.
+func (cs *certStore) load() error {
+	pairs, err := cs.certPairs()
+	if err != nil {
+		return err
+	}
+	modTimes := map[string]time.Time{}
+	for _, pair := range pairs {
+		for _, file := range pair {
+			info, err := os.Stat(file)
+			if err != nil {
+				return err
+			}
+			modTimes[file] = info.ModTime()
+		}
+	}
+	if cs.unchanged(modTimes) {
+		return nil
+	}
+
+	certs := make([]*tls.Certificate, 0, len(pairs))
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return fmt.Errorf("%s: %v", pair[0], err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("%s: %v", pair[0], err)
+			}
+		}
+		certs = append(certs, &cert)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificates found")
+	}
+
+	cs.lock.Lock()
+	cs.certs, cs.modTimes = certs, modTimes
+	cs.lock.Unlock()
+	log.Infof("loaded %d certificates", len(certs))
+	return nil
+}
+
+func (cs *certStore) unchanged(modTimes map[string]time.Time) bool {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	if cs.modTimes == nil || len(modTimes) != len(cs.modTimes) {
+		return false
+	}
+	for file, modTime := range modTimes {
+		if previous, exists := cs.modTimes[file]; !exists || !previous.Equal(modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cs *certStore) watch(interval time.Duration) {
+	for {
+		select {
+		case <-cs.stop:
+			return
+		case <-time.After(interval):
+			if err := cs.load(); err != nil {
+				log.Errorf("reloading certificates: %v", err)
+			}
+		}
+	}
+}
+
+func (cs *certStore) close() {
+	cs.once.Do(func() {
+		close(cs.stop)
+	})
+}
+
+// GetCertificate selects the certificate matching the requested server name,
+// falling back to the first certificate.
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	if len(cs.certs) == 0 {
+		return nil, fmt.Errorf("no certificates loaded")
+	}
+	if len(hello.ServerName) > 0 {
+		for _, cert := range cs.certs {
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return cs.certs[0], nil
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// loadTLS builds the tls configuration of an https listener from its
+// cert_file/key_file and/or cert_dir, client_auth and client_ca_file.
+func loadTLS(config map[string]interface{}) (*tls.Config, *certStore, error) {
+	store := &certStore{
+		certFile: strOrEmpty(config["cert_file"]),
+		keyFile:  strOrEmpty(config["key_file"]),
+		certDir:  strOrEmpty(config["cert_dir"]),
+		stop:     make(chan bool),
+	}
+	if len(store.certFile) == 0 && len(store.certDir) == 0 {
+		return nil, nil, fmt.Errorf("https listener requires cert_file and key_file or cert_dir")
+	}
+	if len(store.certFile) > 0 && len(store.keyFile) == 0 {
+		return nil, nil, fmt.Errorf("https listener cert_file requires a key_file")
+	}
+	if err := store.load(); err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: store.GetCertificate,
+	}
+
+	clientAuth := strOrEmpty(config["client_auth"])
+	if len(clientAuth) == 0 {
+		clientAuth = "none"
+	}
+	authType, ok := clientAuthTypes[clientAuth]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown client_auth '%s', expected none, request or require", clientAuth)
+	}
+	tlsConfig.ClientAuth = authType
+	if caFile := strOrEmpty(config["client_ca_file"]); len(caFile) > 0 {
+		bytes, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bytes) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.ClientCAs = pool
+	} else if authType != tls.NoClientCert {
+		return nil, nil, fmt.Errorf("client_auth '%s' requires a client_ca_file", clientAuth)
+	}
+
+	interval := 10 * time.Second
+	if ms, ok := config["reload_interval_ms"].(float64); ok && ms > 0 {
+		interval = time.Duration(ms) * time.Millisecond
+	}
+	go store.watch(interval)
+	return tlsConfig, store, nil
+}
+
+// tlsData exposes the connection state of an https request to matchers and
+// templates, the verified client certificate is available as tls.client.
+func tlsData(state *tls.ConnectionState) map[string]interface{} {
+	data := map[string]interface{}{
+		"version":     tls.VersionName(state.Version),
+		"cipher":      tls.CipherSuiteName(state.CipherSuite),
+		"server_name": state.ServerName,
+		"protocol":    state.NegotiatedProtocol,
+	}
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		cert := state.VerifiedChains[0][0]
+		data["client"] = map[string]interface{}{
+			"subject":             cert.Subject.String(),
+			"common_name":         cert.Subject.CommonName,
+			"organization":        strings.Join(cert.Subject.Organization, ","),
+			"organizational_unit": strings.Join(cert.Subject.OrganizationalUnit, ","),
+			"country":             strings.Join(cert.Subject.Country, ","),
+			"serial":              cert.SerialNumber.String(),
+			"issuer":              cert.Issuer.String(),
+			"dns_names":           cert.DNSNames,
+			"email":               strings.Join(cert.EmailAddresses, ","),
+			"not_after":           cert.NotAfter.UTC().Format(time.RFC3339),
+		}
+	}
+	return data
+}
+
+// InitTLS creates an https listener, HTTP/2 is negotiated unless "http2" is
+// set to false.
+func InitTLS(config map[string]interface{}, ondata func(map[string]interface{}, http.ResponseWriter)) (*HttpListener, error) {
+	listener, err := Init(config, ondata)
+	if err != nil {
+		return nil, err
+	}
+	if listener.TLS, listener.certs, err = loadTLS(config); err != nil {
+		return nil, err
+	}
+	if enabled, ok := config["http2"].(bool); ok && !enabled {
+		listener.DisableHTTP2 = true
+	} else {
+		listener.TLS.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return listener, nil
+}
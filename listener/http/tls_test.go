@@ -0,0 +1,146 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+	kpem []byte
+}
+
+func issue(t *testing.T, name string, parent *testCert, serial int64) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"aproxy"}},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		kpem: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func (tc *testCert) write(t *testing.T, dir, name string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), tc.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), tc.kpem, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := issue(t, "ca", nil, 1)
+	ioutil.WriteFile(filepath.Join(dir, "ca.pem"), ca.pem, 0600)
+	os.Mkdir(filepath.Join(dir, "server"), 0700)
+	issue(t, "a.example.com", ca, 2).write(t, filepath.Join(dir, "server"), "a")
+	issue(t, "b.example.com", ca, 3).write(t, filepath.Join(dir, "server"), "b")
+
+	tlsConfig, store, err := loadTLS(map[string]interface{}{
+		"cert_dir":           filepath.Join(dir, "server"),
+		"client_auth":        "require",
+		"client_ca_file":     filepath.Join(dir, "ca.pem"),
+		"reload_interval_ms": float64(10),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	if cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"}); cert.Leaf.Subject.CommonName != "b.example.com" {
+		t.Errorf("expected certificate selected by SNI, got %s", cert.Leaf.Subject.CommonName)
+	}
+
+	// certificates are reloaded once their files change
+	time.Sleep(20 * time.Millisecond)
+	issue(t, "c.example.com", ca, 4).write(t, filepath.Join(dir, "server"), "b")
+	os.Chtimes(filepath.Join(dir, "server", "b.crt"), time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cert, _ := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "c.example.com"})
+		if cert.Leaf.Subject.CommonName == "c.example.com" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := tlsData(r.TLS)["client"].(map[string]interface{})
+		fmt.Fprintf(w, "%s/%s", client["common_name"], client["organization"])
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	client := issue(t, "client-1", ca, 5)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	transport := &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "a.example.com",
+		Certificates: []tls.Certificate{{Certificate: [][]byte{client.cert.Raw}, PrivateKey: client.key}},
+	}}
+	response, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "client-1/aproxy" {
+		t.Errorf("unexpected client certificate data: %s", body)
+	}
+
+	transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "a.example.com"}}
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err == nil {
+		t.Errorf("expected requests without client certificate to be rejected")
+	}
+}
@@ -1,13 +1,14 @@
 package listener
 
 import(
+	"context"
 	"github.com/creamdog/aproxy/listener/http"
 	nethttp "net/http"
 )
 
 type Listener interface {
 	Start()
-	Stop()
+	Stop(ctx context.Context) error
 	IsRunning() bool
 }
 
@@ -15,4 +16,7 @@ var Implementations = map[string]func(map[string]interface{}, func(map[string]in
 	"http" : func(config map[string]interface{}, ondata func(map[string]interface{}, nethttp.ResponseWriter)) (Listener, error) {
 		return http.Init(config, ondata)
 	},
+	"https" : func(config map[string]interface{}, ondata func(map[string]interface{}, nethttp.ResponseWriter)) (Listener, error) {
+		return http.InitTLS(config, ondata)
+	},
 }
\ No newline at end of file
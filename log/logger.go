@@ -1,62 +1,262 @@
+// Package log writes leveled, structured log lines in logfmt or json.
 package log
 
 import (
-	"log"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const (  // iota is reset to 0
+const ( // iota is reset to 0
 	DEBUG = iota
-	INFO = iota
-	WARN = iota
-	ERROR = iota 
-	FATAL = iota
+	INFO
+	WARN
+	ERROR
+	FATAL
 )
 
 var levelStrings map[int]string = map[int]string{
-	0 : "DEBUG",
-	1 : "INFO",
-	2 : "WARN",
-	3 : "ERROR",
-	4 : "FATAL",
+	DEBUG: "debug",
+	INFO:  "info",
+	WARN:  "warn",
+	ERROR: "error",
+	FATAL: "fatal",
 }
 
-func Log(level int, v ...interface{}) {
+// Fields are key/value pairs added to every line of a logger.
+type Fields map[string]interface{}
+
+// Logger writes lines carrying its fields, the nil logger has no fields.
+type Logger struct {
+	fields Fields
+}
+
+var minLevel int32 = INFO
+var jsonFormat int32
+var lock = &sync.Mutex{}
+var output io.Writer = os.Stderr
+var exit = os.Exit
+
+// Configure applies the "level" (debug, info, warn, error) and "format"
+// (logfmt, json) of the log config section.
+func Configure(config map[string]interface{}) error {
+	if value, ok := config["level"].(string); ok {
+		level, err := ParseLevel(value)
+		if err != nil {
+			return err
+		}
+		SetLevel(level)
+	}
+	if value, ok := config["format"].(string); ok {
+		if err := SetFormat(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseLevel returns the level named s.
+func ParseLevel(s string) (int, error) {
+	for level, name := range levelStrings {
+		if strings.EqualFold(name, s) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level '%s'", s)
+}
+
+// SetLevel discards lines below level.
+func SetLevel(level int) {
+	atomic.StoreInt32(&minLevel, int32(level))
+}
+
+// Level returns the minimum level written.
+func Level() int {
+	return int(atomic.LoadInt32(&minLevel))
+}
+
+// SetFormat selects "logfmt" or "json" output.
+func SetFormat(format string) error {
+	switch format {
+	case "logfmt":
+		atomic.StoreInt32(&jsonFormat, 0)
+	case "json":
+		atomic.StoreInt32(&jsonFormat, 1)
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+	return nil
+}
+
+// SetOutput sets the destination of log lines.
+func SetOutput(w io.Writer) {
+	lock.Lock()
+	defer lock.Unlock()
+	output = w
+}
+
+// With returns a logger adding fields to every line.
+func With(fields Fields) *Logger {
+	return (*Logger)(nil).With(fields)
+}
+
+// With returns a logger adding fields to those of l.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	if l != nil {
+		for key, value := range l.fields {
+			merged[key] = value
+		}
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return &Logger{fields: merged}
+}
+
+// Enabled reports whether lines of level are written.
+func Enabled(level int) bool {
+	return level >= Level()
+}
+
+func (l *Logger) write(level int, msg string) {
+	if !Enabled(level) {
+		return
+	}
+	var fields Fields
+	if l != nil {
+		fields = l.fields
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	var line strings.Builder
+	if atomic.LoadInt32(&jsonFormat) == 1 {
+		line.WriteString(`{"time":` + jsonValue(now) + `,"level":` + jsonValue(levelStrings[level]) + `,"msg":` + jsonValue(msg))
+		for _, key := range keys {
+			line.WriteString("," + jsonValue(key) + ":" + jsonValue(fields[key]))
+		}
+		line.WriteString("}\n")
+	} else {
+		line.WriteString("time=" + now + " level=" + levelStrings[level] + " msg=" + logfmtValue(msg))
+		for _, key := range keys {
+			line.WriteString(" " + key + "=" + logfmtValue(fields[key]))
+		}
+		line.WriteString("\n")
+	}
+
+	lock.Lock()
+	io.WriteString(output, line.String())
+	lock.Unlock()
+
 	if level >= FATAL {
-		log.Fatalf("[%s] %v", levelStrings[level], fmt.Sprintf("%q", v))
-	} 
-	log.Printf("[%s] %v", levelStrings[level], fmt.Sprintf("%q", v))
+		exit(1)
+	}
+}
+
+func jsonValue(value interface{}) string {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	if bytes, err := json.Marshal(value); err == nil {
+		return string(bytes)
+	}
+	return strconv.Quote(fmt.Sprint(value))
+}
+
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if len(s) == 0 || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.write(DEBUG, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.write(INFO, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.write(WARN, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.write(ERROR, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.write(FATAL, fmt.Sprintf(format, v...))
+}
+
+func Log(level int, v ...interface{}) {
+	(*Logger)(nil).write(level, fmt.Sprint(v...))
 }
 
 func Debugf(format string, v ...interface{}) {
-	Log(DEBUG, fmt.Sprintf(format, v))
+	Log(DEBUG, fmt.Sprintf(format, v...))
 }
 
 func Infof(format string, v ...interface{}) {
-	Log(INFO, fmt.Sprintf(format, v))
+	Log(INFO, fmt.Sprintf(format, v...))
 }
 
 func Warnf(format string, v ...interface{}) {
-	Log(WARN, fmt.Sprintf(format, v))
+	Log(WARN, fmt.Sprintf(format, v...))
 }
 
 func Errorf(format string, v ...interface{}) {
-	Log(ERROR, fmt.Sprintf(format, v))
+	Log(ERROR, fmt.Sprintf(format, v...))
 }
 
-
 func Print(v ...interface{}) {
 	Log(INFO, v...)
 }
 
 func Printf(format string, v ...interface{}) {
-	Log(INFO, fmt.Sprintf(format, v))
+	Log(INFO, fmt.Sprintf(format, v...))
 }
 
 func Fatalf(format string, v ...interface{}) {
-	Log(FATAL, fmt.Sprintf(format, v))
+	Log(FATAL, fmt.Sprintf(format, v...))
 }
 
 func Fatal(v ...interface{}) {
 	Log(FATAL, v...)
-}
\ No newline at end of file
+}
+
+// LevelHandler reports the minimum level on GET and changes it on PUT or
+// POST with a level query parameter.
+func LevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		level, err := ParseLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		SetLevel(level)
+		Warnf("log level set to %s", levelStrings[level])
+	default:
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"level\":%s}\n", jsonValue(levelStrings[Level()]))
+}
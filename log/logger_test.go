@@ -0,0 +1,49 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStructuredOutput(t *testing.T) {
+	var buffer bytes.Buffer
+	SetOutput(&buffer)
+	SetLevel(INFO)
+	defer SetFormat("logfmt")
+
+	logger := With(Fields{"mapping": "search"})
+	logger.Debugf("hidden")
+	logger.Infof("served %d bytes", 42)
+	if line := buffer.String(); strings.Contains(line, "hidden") || !strings.Contains(line, ` level=info msg="served 42 bytes" mapping=search`) {
+		t.Errorf("unexpected logfmt output: %s", line)
+	}
+
+	buffer.Reset()
+	SetFormat("json")
+	logger.With(Fields{"request_id": "abc"}).Warnf("slow")
+	var line map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["level"] != "warn" || line["msg"] != "slow" || line["mapping"] != "search" || line["request_id"] != "abc" {
+		t.Errorf("unexpected json output: %v", line)
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	SetLevel(INFO)
+	SetOutput(&bytes.Buffer{})
+	recorder := httptest.NewRecorder()
+	LevelHandler(recorder, httptest.NewRequest("PUT", "/_admin/log?level=debug", nil))
+	if recorder.Code != 200 || Level() != DEBUG {
+		t.Errorf("expected level debug, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	LevelHandler(recorder, httptest.NewRequest("PUT", "/_admin/log?level=loud", nil))
+	if recorder.Code != 400 {
+		t.Errorf("expected unknown level to be rejected, got %d", recorder.Code)
+	}
+}
@@ -1,24 +1,37 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"github.com/creamdog/aproxy/admin"
 	"github.com/creamdog/aproxy/config"
 	"github.com/creamdog/aproxy/config/file"
 	"github.com/creamdog/aproxy/config/s3"
+	"github.com/creamdog/aproxy/health"
 	"github.com/creamdog/aproxy/listener"
 	"github.com/creamdog/aproxy/mappings"
+	"github.com/creamdog/aproxy/metrics"
+	"github.com/creamdog/aproxy/tracing"
 	"github.com/creamdog/aproxy/cache"
 	httppipe "github.com/creamdog/aproxy/pipes/http"
-	//"log"
+	"github.com/creamdog/aproxy/upstream"
 	"net/http"
-	"time"	
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"github.com/creamdog/aproxy/log"
 )
 
 var mappingsCollection *mappings.Mappings
 var cacheClient cache.CacheClient
 
+var unmatchedRequests = metrics.NewCounter("aproxy_unmatched_requests_total", "Requests not matching any mapping.")
+var matchErrors = metrics.NewCounter("aproxy_match_errors_total", "Requests failing to match or render a mapping.")
+
 const (
-	defaultConfigFile = "config.json"
+	defaultConfigFile      = "config.json"
+	defaultShutdownTimeout = 30 * time.Second
 )
 
 func main() {
@@ -26,6 +39,12 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := log.Configure(config.Log); err != nil {
+		log.Fatal(err)
+	}
+	if err := tracing.Configure(config.Tracing); err != nil {
+		log.Fatal(err)
+	}
 
 	c, err := cache.Get(config.Cache)
 	if err != nil {
@@ -33,41 +52,127 @@ func main() {
 	}
 	cacheClient = c
 
+	if err := upstream.Load(config.Upstreams); err != nil {
+		log.Fatal(err)
+	}
+	admin.HandleFunc("/cache", httppipe.New(cacheClient).CacheAdmin)
+	admin.HandleFunc("/log", log.LevelHandler)
+	admin.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"upstreams":        upstream.Status(),
+			"circuit_breakers": upstream.Breakers(),
+		})
+	})
+
 	mappingsCollection = initializeMappings(config)
+	// a proxy can serve uncached while the cache is down, so the cache only
+	// fails the status check when configured critical
+	cacheCritical, _ := config.Cache["critical"].(bool)
+	stopCacheProbe := health.Probe("cache", cacheCritical, 10*time.Second, func() (interface{}, error) {
+		_, err := cacheClient.Get("aproxy-health-check", nil)
+		return nil, err
+	})
+	health.Register("mappings", false, func() (interface{}, error) {
+		return map[string]interface{}{"loaded": len(*mappingsCollection.Get())}, nil
+	})
 	listeners := initializeListeners(config)
 
+	var stopRepo func()
 	if section, exists := config.MappingRepo["s3"]; exists {
-		s3.Start(mappingsCollection, section.(map[string]interface{}))
+		stopRepo = s3.Start(mappingsCollection, section.(map[string]interface{}))
 	} else {
-		file.Start(mappingsCollection, "mapping-configuration")
+		stopRepo = file.Start(mappingsCollection, "mapping-configuration").Stop
 	}
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	exitCode := 1
 	for listeners.IsRunning() {
-		time.Sleep(1 * time.Second)
+		select {
+		case sig := <-signals:
+			log.Infof("received %v, shutting down", sig)
+			exitCode = 0
+		case <-time.After(1 * time.Second):
+			continue
+		}
+		break
 	}
+
+	timeout := time.Duration(config.ShutdownTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := listeners.Stop(ctx); err != nil {
+		log.Warnf("in-flight requests not drained within %v: %v", timeout, err)
+	}
+	stopRepo()
+	stopCacheProbe()
+	upstream.StopHealthChecks()
+	tracing.Shutdown()
+	log.Infof("stopped")
+	os.Exit(exitCode)
 }
 
 func ondata(data map[string]interface{}, w http.ResponseWriter) {
 
+	logger := log.With(log.Fields{"request_id": mappings.RequestId(data)})
 	mappings := mappingsCollection.Get()
 
 	//log.Printf("mappings: %d, data: %v", len(*mappings), data)
 
-	if requestMapping, err := mappings.GetMatch(data); err != nil {
-		log.Print(err)
+	span := tracing.From(w)
+	matchSpan := span.Child("mappings.match", tracing.KindInternal)
+	compiledMapping, requestData := mappings.Find(data)
+	matchSpan.Finish()
+
+	if compiledMapping == nil {
+		unmatchedRequests.Inc()
+		http.Error(w, "these are not the droids you're looking for", 404)
+		logger.Infof("found no mapping matching request")
+		return
+	}
+	span.SetAttribute("aproxy.mapping", compiledMapping.Mapping.Id)
+
+	prepareSpan := span.Child("mappings.prepare", tracing.KindInternal)
+	requestMapping, err := compiledMapping.Prepare(requestData)
+	prepareSpan.SetError(err)
+	prepareSpan.Finish()
+
+	if err != nil {
+		logger.Errorf("%v", err)
+		matchErrors.Inc()
 		http.Error(w, err.Error(), 500)
-	} else if requestMapping != nil {
-		log.Printf("executing mapping: %v", requestMapping.Id)
+	} else {
+		requestMapping.Log.Debugf("executing mapping")
 		pipe := httppipe.New(cacheClient)
 		pipe.Pipe(requestMapping, w)
-	} else {
-		http.Error(w, "these are not the droids you're looking for", 404)
-		log.Printf("found no mapping matching request")
 	}
 }
 
 type Listeners []listener.Listener
 
+// Stop stops every listener concurrently, draining in-flight requests until
+// ctx is done.
+func (col Listeners) Stop(ctx context.Context) error {
+	errs := make(chan error, len(col))
+	for _, l := range col {
+		go func(l listener.Listener) {
+			errs <- l.Stop(ctx)
+		}(l)
+	}
+	var result error
+	for range col {
+		if err := <-errs; err != nil {
+			result = err
+		}
+	}
+	return result
+}
+
 func (col Listeners) IsRunning() bool {
 	for _, l := range col {
 		if l.IsRunning() {
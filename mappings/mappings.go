@@ -3,58 +3,126 @@ package mappings
 import (
 	"bytes"
 	"fmt"
-	"log"
+	"github.com/creamdog/aproxy/log"
+	"github.com/creamdog/aproxy/metrics"
 	"regexp"
-	"strings"
+	"regexp/syntax"
+	"sort"
 	"sync"
 	"text/template"
 	"io"
 )
 
+// Reloads counts the mapping files loaded by the mapping repositories.
+var Reloads = metrics.NewCounter("aproxy_mapping_reloads_total", "Mapping files loaded per repository and result.", "repo", "result")
+
 type Mapping struct {
 	Id      string
+	Priority int
 	Target  *TargetMapping
 	Mapping map[string][]string
 	Caching *CacheStrategy
+	Retry   *RetryPolicy
+	Fallback *Fallback
+	RateLimit *RateLimit
 }
 
+const DefaultMaxBodySize = 1 * 1024 * 1024
+
 type CacheStrategy struct {
 	Key string
 	Seconds int
+	StaleSeconds int
+	MaxSize int
+	StatusCodes []int
+	CacheControl bool
+	Vary bool
+}
+
+// Caches reports whether responses with the status code may be cached.
+func (cs *CacheStrategy) Caches(statusCode int) bool {
+	if cs == nil {
+		return false
+	}
+	for _, code := range cs.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
 }
 
 type TargetMapping struct {
+	Name    string
 	Headers map[string]string
 	Verb    string
 	Body    string
 	Uri     string
+	Upstream string
+	HashKey string
 	Stub	bool
+	StatusCode string
 	Transform *TargetTransform
+	Targets map[string]*TargetMapping
+	FailureMode string
+	Steps []*TargetMapping
+	OnError *ErrorResponse
 }
 type TargetTransform struct {
 	Type string
 	Regexp *regexp.Regexp
 	Template string
 	Headers map[string]string
+	MaxInputSize int
 }
 
 func (q *Mapping) Compile() (*CompiledMapping, error) {
-	body, err := template.New(q.Id + "_body").Parse(q.Target.Body)
+	target, err := compileTarget(q.Id, "", q.Target)
 	if err != nil {
 		return nil, err
 	}
-	url, err := template.New(q.Id + "_url").Parse(q.Target.Uri)
+
+	targets, err := compileTargets(q.Id, q.Target.Targets)
 	if err != nil {
 		return nil, err
 	}
 
+	steps, err := compileSteps(q.Id, q.Target.Steps)
+	if err != nil {
+		return nil, err
+	}
+
+	var onError *template.Template
+	if q.Target.OnError != nil {
+		onError, err = template.New(q.Id + "_onerror").Parse(q.Target.OnError.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var fallback *template.Template
+	if q.Fallback != nil && q.Fallback.Response != nil {
+		fallback, err = template.New(q.Id + "_fallback").Parse(q.Fallback.Response.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rateLimitKey *template.Template
+	if q.RateLimit != nil {
+		rateLimitKey, err = template.New(q.Id + "_ratelimitkey").Parse(q.RateLimit.Key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var transform *template.Template
 	if q.Target.Transform != nil {
 		transform, err = template.New(q.Id + "_transform").Parse(q.Target.Transform.Template)
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("%v => compiled target transform: %v", q.Id, q.Target.Transform.Template)
+		log.With(log.Fields{"mapping": q.Id}).Debugf("compiled target transform: %v", q.Target.Transform.Template)
 	}
 
 	var cacheKey *template.Template
@@ -64,7 +132,7 @@ func (q *Mapping) Compile() (*CompiledMapping, error) {
 		if err != nil {
 			return nil, err
 		}
-		log.Printf("%v => compiled cache key: %v", q.Id, q.Caching.Key)
+		log.With(log.Fields{"mapping": q.Id}).Debugf("compiled cache key: %v", q.Caching.Key)
 	}
 
 	compiledMappings := map[string][]*regexp.Regexp{}
@@ -78,26 +146,34 @@ func (q *Mapping) Compile() (*CompiledMapping, error) {
 				compiledMappings[key] = make([]*regexp.Regexp, 0)
 			}
 			compiledMappings[key] = append(compiledMappings[key], compiledRegexp)
-			log.Printf("compiled mapping %v[%v](%v)\n", q.Id, key, value)
+			log.With(log.Fields{"mapping": q.Id}).Debugf("compiled mapping %v(%v)", key, value)
 		}
 	}
 
 	return &CompiledMapping{
 		Mapping:         q,
-		CompiledBody:    body,
-		CompiledUrl:     url,
+		CompiledTarget:  target,
+		CompiledTargets: targets,
+		CompiledSteps:   steps,
+		CompiledOnError: onError,
+		CompiledFallback: fallback,
 		CompiledTransform: transform,
 		CompiledMapping: compiledMappings,
 		CompiledCacheKey: cacheKey,
+		CompiledRateLimitKey: rateLimitKey,
 	}, nil
 }
 
 type CompiledMapping struct {
 	Mapping         *Mapping
-	CompiledBody    *template.Template
-	CompiledUrl     *template.Template
+	*CompiledTarget
+	CompiledTargets []*CompiledTarget
+	CompiledSteps   []*CompiledTarget
+	CompiledOnError *template.Template
+	CompiledFallback *template.Template
 	CompiledTransform     *template.Template
 	CompiledCacheKey *template.Template
+	CompiledRateLimitKey *template.Template
 	CompiledMapping map[string][]*regexp.Regexp
 }
 
@@ -112,6 +188,14 @@ type RequestMapping struct {
 	Data    *map[string]interface{}
 	CacheKey string
 	RequestStream io.ReadCloser
+	StatusCode int
+	HashKey string
+	Targets []*CompiledTarget
+	Steps []*CompiledTarget
+	CompiledOnError *template.Template
+	CompiledFallback *template.Template
+	RateLimitKey string
+	Log *log.Logger
 }
 
 func (cm *CompiledMapping) Prepare(data map[string]interface{}) (*RequestMapping, error) {
@@ -124,31 +208,50 @@ func (cm *CompiledMapping) Prepare(data map[string]interface{}) (*RequestMapping
 		return nil, err
 	}
 
-	headers := map[string]string{}
-	for key, value := range cm.Mapping.Target.Headers {
-		if len(value) > 0 {
-			headers[key] = value
-		} else if headerdata, exists := data["header"].(map[string]interface{}); exists {
-			for k, value := range headerdata {
-				if strings.ToLower(k) == strings.ToLower(key) {
-					if str, isString := value.(string); isString {
-						headers[key] = str
-					} else if strArray, isStringArray := value.([]string); isStringArray {
-						headers[key] = strArray[0]
-					}
-				}
-			}
-		}
+	headers, err := cm.Headers(data)
+	if err != nil {
+		return nil, err
+	}
+	statusCode, err := cm.StatusCode(data)
+	if err != nil {
+		return nil, err
+	}
+	hashKey, err := cm.HashKey(data)
+	if err != nil {
+		return nil, err
 	}
 
 	cachekey := ""
 	if cm.CompiledCacheKey != nil {
 		var buffer bytes.Buffer
 		if err := cm.CompiledCacheKey.Execute(&buffer, data); err != nil {
-			log.Printf("unable to transform cache key", err)
+			log.With(log.Fields{"mapping": cm.Mapping.Id}).Errorf("unable to transform cache key: %v", err)
 		}
 		cachekey = buffer.String()
-		log.Printf("transformed cache key: %s", cachekey)
+	}
+
+	rateLimitKey := ""
+	if cm.CompiledRateLimitKey != nil {
+		var buffer bytes.Buffer
+		if err := cm.CompiledRateLimitKey.Execute(&buffer, data); err != nil {
+			return nil, err
+		}
+		// clients the key cannot be rendered for are told apart by address
+		// rather than sharing a single bucket
+		rateLimitKey = buffer.String()
+		if len(rateLimitKey) == 0 || rateLimitKey == "<no value>" {
+			request, _ := data["request"].(map[string]interface{})
+			rateLimitKey = strOrEmpty(request["remote_addr"])
+		}
+	}
+
+	fields := log.Fields{"mapping": cm.Mapping.Id}
+	if id := RequestId(data); len(id) > 0 {
+		fields["request_id"] = id
+	}
+	logger := log.With(fields)
+	if len(cachekey) > 0 {
+		logger.Debugf("transformed cache key: %s", cachekey)
 	}
 
 	return &RequestMapping{
@@ -157,30 +260,22 @@ func (cm *CompiledMapping) Prepare(data map[string]interface{}) (*RequestMapping
 		Headers: headers,
 		Verb:    cm.Mapping.Target.Verb,
 		Uri:     uri,
+		StatusCode: statusCode,
+		HashKey: hashKey,
 		Mapping: cm.Mapping,
 		CompiledTransform: cm.CompiledTransform,
 		Data: &data,
 		RequestStream: data["request"].(map[string]interface{})["body"].(io.ReadCloser),
 		CacheKey: cachekey,
+		Targets: cm.CompiledTargets,
+		Steps: cm.CompiledSteps,
+		CompiledOnError: cm.CompiledOnError,
+		CompiledFallback: cm.CompiledFallback,
+		RateLimitKey: rateLimitKey,
+		Log: logger,
 	}, nil
 }
 
-func (cm *CompiledMapping) Body(data map[string]interface{}) (string, error) {
-	var buffer bytes.Buffer
-	if err := cm.CompiledBody.Execute(&buffer, data); err != nil {
-		return "", err
-	}
-	return buffer.String(), nil
-}
-
-func (cm *CompiledMapping) Uri(data map[string]interface{}) (string, error) {
-	var buffer bytes.Buffer
-	if err := cm.CompiledUrl.Execute(&buffer, data); err != nil {
-		return "", err
-	}
-	return buffer.String(), nil
-}
-
 type Mappings []*CompiledMapping
 
 func flatten(keypath string, d map[string]interface{}) map[string]interface{} {
@@ -202,43 +297,122 @@ func flatten(keypath string, d map[string]interface{}) map[string]interface{} {
 	return tmp
 }
 
-func (m Mappings) GetMatch(complexData map[string]interface{}) (*RequestMapping, error) {
-	data := flatten("", complexData)
-	for _, cm := range m {
-		isMatch := true
-		for key, regexpList := range cm.CompiledMapping {
-			//log.Printf("checking %q, key: %v, data: %q", m, key, data)
-			if value, exists := data[key]; !exists {
-				isMatch = false
-				break
-			} else {
-				for _, regexp := range regexpList {
-					if values, ok := value.([]string); ok {
-						for _, value := range values {
-							//log.Printf("checking VALUE %q, key: %v, value: %v", m, key, value)
-							if regexp.Match([]byte(value)) {
-								break
-							}
-							isMatch = false
-						}
-					} else if value, ok := value.(string); ok {
-						//log.Printf("checking VALUE %q, key: %v, value: %v", m, key, value)
-						if !regexp.Match([]byte(value)) {
-							isMatch = false
-							break
-						}
+// Match checks the flattened request data against every compiled matcher,
+// returning the named capture groups of the matching expressions.
+func (cm *CompiledMapping) Match(data map[string]interface{}) (map[string]interface{}, bool) {
+	captures := map[string]interface{}{}
+	for key, regexpList := range cm.CompiledMapping {
+		value, exists := data[key]
+		if !exists {
+			return nil, false
+		}
+		for _, regexp := range regexpList {
+			var submatch []string
+			if values, ok := value.([]string); ok {
+				for _, value := range values {
+					if submatch = regexp.FindStringSubmatch(value); submatch != nil {
+						break
 					}
 				}
+			} else if value, ok := value.(string); ok {
+				submatch = regexp.FindStringSubmatch(value)
+			} else {
+				continue
+			}
+			if submatch == nil {
+				return nil, false
+			}
+			for i, name := range regexp.SubexpNames() {
+				if len(name) > 0 {
+					captures[name] = submatch[i]
+				}
 			}
 		}
-		if isMatch {
-			log.Printf("matched")
-			return cm.Prepare(complexData)
+	}
+	return captures, true
+}
+
+// RequestId returns the id the listener assigned to the request of data.
+func RequestId(data map[string]interface{}) string {
+	if request, ok := data["request"].(map[string]interface{}); ok {
+		if id, ok := request["id"].(string); ok {
+			return id
 		}
 	}
+	return ""
+}
+
+func (m Mappings) GetMatch(complexData map[string]interface{}) (*RequestMapping, error) {
+	if cm, requestData := m.Find(complexData); cm != nil {
+		return cm.Prepare(requestData)
+	}
 	return nil, nil
 }
 
+// Find returns the first mapping matching the request data along with the
+// data to prepare it with, which includes the named captures as "match".
+func (m Mappings) Find(complexData map[string]interface{}) (*CompiledMapping, map[string]interface{}) {
+	data := flatten("", complexData)
+	for _, cm := range m {
+		if captures, isMatch := cm.Match(data); isMatch {
+			log.With(log.Fields{"mapping": cm.Mapping.Id}).Debugf("matched, captures: %v", captures)
+			requestData := map[string]interface{}{}
+			for key, value := range complexData {
+				requestData[key] = value
+			}
+			requestData["match"] = captures
+			return cm, requestData
+		}
+	}
+	return nil, nil
+}
+
+// Specificity ranks mappings of equal priority, mappings with more expressions
+// and more literal characters in them are considered more specific.
+func (cm *CompiledMapping) Specificity() (int, int) {
+	expressions, literals := 0, 0
+	for _, regexpList := range cm.CompiledMapping {
+		for _, regexp := range regexpList {
+			expressions++
+			if re, err := syntax.Parse(regexp.String(), syntax.Perl); err == nil {
+				literals += countLiterals(re)
+			}
+		}
+	}
+	return expressions, literals
+}
+
+func countLiterals(re *syntax.Regexp) int {
+	count := 0
+	if re.Op == syntax.OpLiteral {
+		count += len(re.Rune)
+	}
+	for _, sub := range re.Sub {
+		count += countLiterals(sub)
+	}
+	return count
+}
+
+// sort orders the mappings by descending priority, then specificity and
+// finally by id so that the match order does not depend on load order.
+func (list *Mappings) sort() {
+	sort.SliceStable(*list, func(i, j int) bool {
+		a, b := (*list)[i], (*list)[j]
+		if a.Mapping.Priority != b.Mapping.Priority {
+			return a.Mapping.Priority > b.Mapping.Priority
+		}
+		aExpressions, aLiterals := a.Specificity()
+		bExpressions, bLiterals := b.Specificity()
+		if aExpressions != bExpressions {
+			return aExpressions > bExpressions
+		}
+		if aLiterals != bLiterals {
+			return aLiterals > bLiterals
+		}
+		return a.Mapping.Id < b.Mapping.Id
+	})
+}
+
 var registerMutex *sync.Mutex = &sync.Mutex{}
 
 func (list *Mappings) Get() *Mappings {
@@ -260,7 +434,7 @@ func (list *Mappings) DeRegister(ids []string) {
 			deleted = false
 			for i, value := range *list {
 				if value.Mapping.Id == id {
-					log.Printf("deleting %v", id)
+					log.Infof("deleting %v", id)
 					*list = (*list)[:i+copy((*list)[i:], (*list)[i+1:])]
 					deleted = true
 					break
@@ -274,6 +448,7 @@ func (list *Mappings) Register(config map[string]interface{}) ([]string, error)
 
 	registerMutex.Lock()
 	defer registerMutex.Unlock()
+	defer list.sort()
 
 	loadedIds := make([]string, 0)
 
@@ -284,7 +459,7 @@ func (list *Mappings) Register(config map[string]interface{}) ([]string, error)
 			deleted = false
 			for i, value := range *list {
 				if value.Mapping.Id == id {
-					log.Printf("deleting %v", id)
+					log.Infof("deleting %v", id)
 					*list = (*list)[:i+copy((*list)[i:], (*list)[i+1:])]
 					deleted = true
 					break
@@ -292,7 +467,7 @@ func (list *Mappings) Register(config map[string]interface{}) ([]string, error)
 			}
 		}
 
-		transform, err := parseTargetTransform(data.(map[string]interface{})["target"].(map[string]interface{})["transform"])
+		target, err := parseTargetMapping(id, data.(map[string]interface{})["target"].(map[string]interface{}))
 		if err != nil {
 			return nil, err
 		}
@@ -303,28 +478,31 @@ func (list *Mappings) Register(config map[string]interface{}) ([]string, error)
 			cache = &CacheStrategy{
 				Key : cacheConfig.(map[string]interface{})["key"].(string),
 				Seconds : int(cacheConfig.(map[string]interface{})["duration_seconds"].(float64)),
+				StaleSeconds : intOrZero(cacheConfig.(map[string]interface{})["stale_seconds"]),
+				MaxSize : intOrDefault(cacheConfig.(map[string]interface{})["max_size_bytes"], DefaultMaxBodySize),
+				StatusCodes : []int{200},
+				CacheControl : boolOrFalse(cacheConfig.(map[string]interface{})["cache_control"]),
+				Vary : boolOrFalse(cacheConfig.(map[string]interface{})["vary"]),
+			}
+			if codes, ok := cacheConfig.(map[string]interface{})["status_codes"].([]interface{}); ok {
+				cache.StatusCodes = make([]int, 0)
+				for _, code := range codes {
+					cache.StatusCodes = append(cache.StatusCodes, intOrZero(code))
+				}
 			}
 		}
 
-		log.Printf("cache: %v", cache)
+		log.With(log.Fields{"mapping": id}).Debugf("cache: %v", cache)
+
+		rateLimit, err := parseRateLimit(data.(map[string]interface{})["rate_limit"])
+		if err != nil {
+			return nil, err
+		}
 
 		m := &Mapping{
 			Id: id,
-			Target: &TargetMapping{
-				Headers: func() map[string]string {
-					tmp := data.(map[string]interface{})["target"].(map[string]interface{})["headers"].(map[string]interface{})
-					list := map[string]string{}
-					for key, v := range tmp {
-						list[key] = v.(string)
-					}
-					return list
-				}(),
-				Verb: strOrEmpty(data.(map[string]interface{})["target"].(map[string]interface{})["verb"]),
-				Stub: boolOrFalse(data.(map[string]interface{})["target"].(map[string]interface{})["stub"]),
-				Body: strOrEmpty(data.(map[string]interface{})["target"].(map[string]interface{})["body"]),
-				Uri:  strOrEmpty(data.(map[string]interface{})["target"].(map[string]interface{})["uri"]),
-				Transform: transform,
-			},
+			Priority: intOrZero(data.(map[string]interface{})["priority"]),
+			Target: target,
 			Mapping: func() map[string][]string {
 				tmp := map[string][]string{}
 				for key, value := range data.(map[string]interface{})["mapping"].(map[string]interface{}) {
@@ -336,12 +514,15 @@ func (list *Mappings) Register(config map[string]interface{}) ([]string, error)
 							tmp[key] = append(tmp[key], v.(string))
 						}
 					} else {
-						log.Fatal(fmt.Errorf("unsupported mapping %s[%q] = %q", id, key, value))
+						log.Fatalf("unsupported mapping %s[%q] = %q", id, key, value)
 					}
 				}
 				return tmp
 			}(),
 			Caching : cache,
+			Retry : parseRetryPolicy(data.(map[string]interface{})["retry"]),
+			Fallback : parseFallback(data.(map[string]interface{})["fallback"]),
+			RateLimit : rateLimit,
 		}
 
 		if len(m.Mapping) == 0 {
@@ -351,7 +532,7 @@ func (list *Mappings) Register(config map[string]interface{}) ([]string, error)
 		if compiled, err := m.Compile(); err != nil {
 			return nil, err
 		} else {
-			log.Printf("loaded mapping '%v'\n", id)
+			log.Infof("loaded mapping '%v'", id)
 			loadedIds = append(loadedIds, id)
 			*list = append(*list, compiled)
 		}
@@ -361,10 +542,14 @@ func (list *Mappings) Register(config map[string]interface{}) ([]string, error)
 
 func parseTargetTransform(data interface{}) (*TargetTransform, error) {
 	if m, exist := data.(map[string]interface{}); exist {
-		log.Printf("loading transformation: %v", m)
+		log.Debugf("loading transformation: %v", m)
 		t := &TargetTransform{
-			Type: m["type"].(string),
-			Template: m["template"].(string),
+			Type: strOrEmpty(m["type"]),
+			Template: strOrEmpty(m["template"]),
+			MaxInputSize: intOrDefault(m["max_input_bytes"], DefaultMaxBodySize),
+		}
+		if len(t.Type) == 0 {
+			t.Type = "json"
 		}
 
 		if value, exists := m["headers"]; exists {
@@ -375,7 +560,7 @@ func parseTargetTransform(data interface{}) (*TargetTransform, error) {
 						t.Headers[key] = value
 					}
 				}
-				log.Printf("loaded headers: %v\n", t.Headers)
+				log.Debugf("loaded headers: %v", t.Headers)
 			}
 		}
 
@@ -384,7 +569,7 @@ func parseTargetTransform(data interface{}) (*TargetTransform, error) {
 			if err != nil {
 				return nil, err
 			}
-			log.Printf("compiled regexp: %v", expr)
+			log.Debugf("compiled regexp: %v", expr)
 			t.Regexp = r
 		}
 		return t, nil
@@ -409,6 +594,18 @@ func strOrEmpty(v interface{}) string {
 	}
 }
 
+func intOrZero(v interface{}) int {
+	return intOrDefault(v, 0)
+}
+
+func intOrDefault(v interface{}, fallback int) int {
+	if value, ok := v.(float64); ok {
+		return int(value)
+	} else {
+		return fallback
+	}
+}
+
 func boolOrFalse(v interface{}) bool {
 	if value, ok := v.(bool); ok {
 		return value
@@ -0,0 +1,159 @@
+package mappings
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func load(t *testing.T, config string) *Mappings {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(config), &data); err != nil {
+		t.Fatal(err)
+	}
+	list, err := Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func request(method, path string) map[string]interface{} {
+	return map[string]interface{}{
+		"request": map[string]interface{}{
+			"method": method,
+			"path":   path,
+			"body":   ioutil.NopCloser(strings.NewReader("")),
+		},
+		"query":  map[string]interface{}{},
+		"header": map[string]interface{}{},
+	}
+}
+
+func TestNamedCaptures(t *testing.T) {
+	list := load(t, `{
+		"tweet" : {
+			"target" : {
+				"headers" : {"X-Tweet" : "{{.match.id}}"},
+				"verb" : "GET",
+				"uri" : "http://api/{{.match.user}}/{{.match.id}}"
+			},
+			"mapping" : {
+				"request.path" : "^/(?P<user>\\w+)/(?P<id>\\d+)$",
+				"request.method" : "(?P<method>GET)"
+			},
+			"cache_strategy" : {"key" : "{{.match.id}}", "duration_seconds" : 10}
+		}
+	}`)
+
+	rm, err := list.GetMatch(request("GET", "/creamdog/42"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rm == nil {
+		t.Fatal("expected a match")
+	}
+	if rm.Uri != "http://api/creamdog/42" {
+		t.Errorf("unexpected uri: %s", rm.Uri)
+	}
+	if rm.Headers["X-Tweet"] != "42" {
+		t.Errorf("unexpected header: %v", rm.Headers)
+	}
+	if rm.CacheKey != "tweet:42" {
+		t.Errorf("unexpected cache key: %s", rm.CacheKey)
+	}
+
+	if rm, _ := list.GetMatch(request("GET", "/creamdog/abc")); rm != nil {
+		t.Errorf("unexpected match: %v", rm.Id)
+	}
+}
+
+func TestMatchOrder(t *testing.T) {
+	list := load(t, `{
+		"any" : {
+			"target" : {"verb" : "GET", "uri" : "http://any"},
+			"mapping" : {"request.path" : ".*"}
+		},
+		"users" : {
+			"target" : {"verb" : "GET", "uri" : "http://users"},
+			"mapping" : {"request.path" : "^/users/.*"}
+		},
+		"user" : {
+			"target" : {"verb" : "GET", "uri" : "http://user"},
+			"mapping" : {"request.path" : "^/users/\\d+$", "request.method" : "GET"}
+		}
+	}`)
+
+	for path, id := range map[string]string{"/users/1": "user", "/users/x": "users", "/": "any"} {
+		if rm, _ := list.GetMatch(request("GET", path)); rm == nil || rm.Id != id {
+			t.Errorf("%s: expected %s, got %v", path, id, rm)
+		}
+	}
+
+	var config map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"any" : {
+			"priority" : 10,
+			"target" : {"verb" : "GET", "uri" : "http://any"},
+			"mapping" : {"request.path" : ".*"}
+		}
+	}`), &config)
+	list.Register(config)
+
+	if rm, _ := list.GetMatch(request("GET", "/users/1")); rm == nil || rm.Id != "any" {
+		t.Errorf("expected priority mapping to win, got %v", rm)
+	}
+}
+
+func TestUnknownUpstream(t *testing.T) {
+	var config map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"typo" : {
+			"target" : {"verb" : "GET", "uri" : "http://typo", "upstream" : "missing"},
+			"mapping" : {"request.path" : "^/typo$"}
+		}
+	}`), &config)
+	if _, err := Load(config); err == nil || !strings.Contains(err.Error(), "unknown upstream: missing") {
+		t.Errorf("expected unknown upstream error, got %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	list := load(t, `{
+		"limited" : {
+			"target" : {"verb" : "GET", "uri" : "http://limited"},
+			"mapping" : {"request.path" : "^/limited$"},
+			"rate_limit" : {"key" : "{{index .header \"x-api-key\"}}", "rate" : 1, "per_seconds" : 60}
+		}
+	}`)
+	data := request("GET", "/limited")
+	data["request"].(map[string]interface{})["remote_addr"] = "10.0.0.1"
+	if rm, err := list.GetMatch(data); err != nil || rm.RateLimitKey != "10.0.0.1" {
+		t.Errorf("expected a missing key to fall back to the client address, got %v %v", rm, err)
+	}
+	data = request("GET", "/limited")
+	data["header"].(map[string]interface{})["x-api-key"] = "secret"
+	if rm, err := list.GetMatch(data); err != nil || rm.RateLimitKey != "secret" {
+		t.Errorf("expected the rendered key, got %v %v", rm, err)
+	}
+
+	limit := (*list)[0].Mapping.RateLimit
+	limit.maxBuckets = 2
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		if q := limit.Take(key, now); !q.Allowed {
+			t.Errorf("%s: expected first request to be allowed", key)
+		}
+	}
+	if len(limit.buckets) != 2 {
+		t.Errorf("expected buckets bounded to 2, got %d", len(limit.buckets))
+	}
+	if q := limit.Take("c", now); q.Allowed {
+		t.Errorf("expected recent bucket to be kept")
+	}
+	if q := limit.Take("a", now); !q.Allowed {
+		t.Errorf("expected least recently used bucket to be evicted")
+	}
+}
@@ -0,0 +1,149 @@
+package mappings
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRateLimitKey = "{{.request.remote_addr}}"
+	// defaultMaxBuckets bounds the clients tracked per mapping, the least
+	// recently seen client starts over with a full bucket once exceeded
+	defaultMaxBuckets = 10000
+	sweepInterval     = time.Minute
+)
+
+// RateLimit allows Rate requests per PerSeconds for every rendered Key, with
+// bursts of up to Burst requests.
+type RateLimit struct {
+	Key        string
+	Rate       int
+	PerSeconds int
+	Burst      int
+	// Shared limits are counted in the cache, across every aproxy node
+	Shared bool
+
+	lock       sync.Mutex
+	maxBuckets int
+	buckets    map[string]*list.Element
+	order      *list.List
+	sweeping   bool
+}
+
+// Quota is the outcome of taking a request from a rate limit.
+type Quota struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the limit is fully replenished
+	Reset time.Duration
+	// Retry is the time until the next request is allowed
+	Retry time.Duration
+}
+
+type bucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+func parseRateLimit(data interface{}) (*RateLimit, error) {
+	m, exists := data.(map[string]interface{})
+	if !exists {
+		return nil, nil
+	}
+	limit := &RateLimit{
+		Key:        strOrEmpty(m["key"]),
+		Rate:       intOrZero(m["rate"]),
+		PerSeconds: intOrDefault(m["per_seconds"], 1),
+		Shared:     boolOrFalse(m["shared"]),
+		maxBuckets: defaultMaxBuckets,
+		buckets:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+	limit.Burst = intOrDefault(m["burst"], limit.Rate)
+	if len(limit.Key) == 0 {
+		limit.Key = defaultRateLimitKey
+	}
+	if limit.Rate < 1 || limit.PerSeconds < 1 || limit.Burst < 1 {
+		return nil, fmt.Errorf("rate_limit requires a positive rate, per_seconds and burst: %v", m)
+	}
+	return limit, nil
+}
+
+// PerSecond returns the number of requests added to a bucket every second.
+func (rl *RateLimit) PerSecond() float64 {
+	return float64(rl.Rate) / float64(rl.PerSeconds)
+}
+
+func (rl *RateLimit) refill(b *bucket, now time.Time) float64 {
+	return math.Min(float64(rl.Burst), b.tokens+now.Sub(b.updated).Seconds()*rl.PerSecond())
+}
+
+// Take removes a token from the bucket of key, refilling the bucket at Rate
+// per PerSeconds up to Burst tokens first.
+func (rl *RateLimit) Take(key string, now time.Time) Quota {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	element, exists := rl.buckets[key]
+	if exists {
+		rl.order.MoveToFront(element)
+	} else {
+		if rl.order.Len() >= rl.maxBuckets {
+			rl.remove(rl.order.Back())
+		}
+		element = rl.order.PushFront(&bucket{key: key, tokens: float64(rl.Burst), updated: now})
+		rl.buckets[key] = element
+		if !rl.sweeping {
+			rl.sweeping = true
+			time.AfterFunc(sweepInterval, rl.sweep)
+		}
+	}
+	b := element.Value.(*bucket)
+	b.tokens = rl.refill(b, now)
+	b.updated = now
+
+	q := Quota{Limit: rl.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		q.Allowed = true
+	} else {
+		q.Retry = seconds((1 - b.tokens) / rl.PerSecond())
+	}
+	q.Remaining = int(b.tokens)
+	q.Reset = seconds((float64(rl.Burst) - b.tokens) / rl.PerSecond())
+	return q
+}
+
+// sweep drops the buckets that have refilled completely, they hold nothing a
+// new bucket would not. Sweeping stops once no buckets are left.
+func (rl *RateLimit) sweep() {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	now := time.Now()
+	for element := rl.order.Back(); element != nil; {
+		previous := element.Prev()
+		if rl.refill(element.Value.(*bucket), now) >= float64(rl.Burst) {
+			rl.remove(element)
+		}
+		element = previous
+	}
+	if rl.order.Len() > 0 {
+		time.AfterFunc(sweepInterval, rl.sweep)
+	} else {
+		rl.sweeping = false
+	}
+}
+
+func (rl *RateLimit) remove(element *list.Element) {
+	rl.order.Remove(element)
+	delete(rl.buckets, element.Value.(*bucket).key)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
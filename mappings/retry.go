@@ -0,0 +1,90 @@
+package mappings
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+)
+
+var idempotentVerbs = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	StatusCodes []int
+	// Verbs lists non idempotent verbs explicitly opted in to retries
+	Verbs []string
+}
+
+func parseRetryPolicy(data interface{}) *RetryPolicy {
+	m, exists := data.(map[string]interface{})
+	if !exists {
+		return nil
+	}
+	policy := &RetryPolicy{
+		MaxAttempts: intOrDefault(m["max_attempts"], 3),
+		BaseDelay:   time.Duration(intOrDefault(m["base_delay_ms"], 50)) * time.Millisecond,
+		MaxDelay:    time.Duration(intOrDefault(m["max_delay_ms"], 1000)) * time.Millisecond,
+		StatusCodes: []int{502, 503, 504},
+		Verbs:       []string{},
+	}
+	if codes, ok := m["status_codes"].([]interface{}); ok {
+		policy.StatusCodes = make([]int, 0)
+		for _, code := range codes {
+			policy.StatusCodes = append(policy.StatusCodes, intOrZero(code))
+		}
+	}
+	if verbs, ok := m["verbs"].([]interface{}); ok {
+		for _, verb := range verbs {
+			policy.Verbs = append(policy.Verbs, strings.ToUpper(strOrEmpty(verb)))
+		}
+	}
+	return policy
+}
+
+// Attempts returns how many times a request with the verb may be sent, only
+// idempotent and explicitly listed verbs are retried. An empty verb is sent
+// as GET.
+func (rp *RetryPolicy) Attempts(verb string) int {
+	if rp == nil || rp.MaxAttempts < 1 {
+		return 1
+	}
+	if verb = strings.ToUpper(verb); len(verb) == 0 {
+		verb = "GET"
+	}
+	for _, list := range [][]string{idempotentVerbs, rp.Verbs} {
+		for _, v := range list {
+			if v == verb {
+				return rp.MaxAttempts
+			}
+		}
+	}
+	return 1
+}
+
+func (rp *RetryPolicy) RetriesStatus(statusCode int) bool {
+	for _, code := range rp.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns the delay before the attempt following the given one, the
+// delay doubles with every attempt up to MaxDelay and is jittered between
+// half and all of it.
+func (rp *RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := rp.BaseDelay
+	for i := 1; i < attempt && delay < rp.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > rp.MaxDelay {
+		delay = rp.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
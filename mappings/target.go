@@ -0,0 +1,348 @@
+package mappings
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/creamdog/aproxy/log"
+	"github.com/creamdog/aproxy/upstream"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	FailAll    = "fail_all"
+	BestEffort = "best_effort"
+)
+
+type CompiledTarget struct {
+	Name            string
+	Target          *TargetMapping
+	CompiledBody    *template.Template
+	CompiledUrl     *template.Template
+	CompiledHeaders map[string]*template.Template
+	// CompiledStatusCode renders the status code of stubbed targets
+	CompiledStatusCode *template.Template
+	// CompiledHashKey renders the key selecting the server of upstreams
+	// balanced by consistent hashing
+	CompiledHashKey *template.Template
+}
+
+type ErrorResponse struct {
+	StatusCode int
+	Body       string
+	Headers    map[string]string
+}
+
+type RequestTarget struct {
+	Name      string
+	Body      string
+	Headers   map[string]string
+	Verb      string
+	Uri       string
+	Upstream  string
+	HashKey   string
+	Transform *TargetTransform
+}
+
+func compileTarget(id string, name string, target *TargetMapping) (*CompiledTarget, error) {
+	prefix := id
+	if len(name) > 0 {
+		prefix = id + "_" + name
+	}
+	if !target.Stub {
+		if _, err := upstream.Get(target.Upstream); err != nil {
+			return nil, fmt.Errorf("mapping %s: %v", prefix, err)
+		}
+	}
+	body, err := template.New(prefix + "_body").Parse(target.Body)
+	if err != nil {
+		return nil, err
+	}
+	url, err := template.New(prefix + "_url").Parse(target.Uri)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]*template.Template{}
+	for key, value := range target.Headers {
+		if len(value) == 0 {
+			continue
+		}
+		headers[key], err = template.New(prefix + "_header_" + key).Parse(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var statusCode *template.Template
+	if target.Stub {
+		if statusCode, err = template.New(prefix + "_statuscode").Parse(target.StatusCode); err != nil {
+			return nil, err
+		}
+	}
+
+	hashKey, err := template.New(prefix + "_hashkey").Parse(target.HashKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CompiledTarget{
+		Name:               name,
+		Target:             target,
+		CompiledBody:       body,
+		CompiledUrl:        url,
+		CompiledHeaders:    headers,
+		CompiledStatusCode: statusCode,
+		CompiledHashKey:    hashKey,
+	}, nil
+}
+
+// compileTargets compiles the named sub targets of a fan-out mapping, ordered
+// by name so that requests are issued deterministically.
+func compileTargets(id string, targets map[string]*TargetMapping) ([]*CompiledTarget, error) {
+	list := make([]*TargetMapping, 0, len(targets))
+	for _, target := range targets {
+		list = append(list, target)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return compileSteps(id, list)
+}
+
+// compileSteps compiles an ordered list of named targets.
+func compileSteps(id string, targets []*TargetMapping) ([]*CompiledTarget, error) {
+	compiled := make([]*CompiledTarget, 0, len(targets))
+	for _, target := range targets {
+		ct, err := compileTarget(id, target.Name, target)
+		if err != nil {
+			return nil, err
+		}
+		log.With(log.Fields{"mapping": id}).Debugf("compiled target %v: %v %v", target.Name, target.Verb, target.Uri)
+		compiled = append(compiled, ct)
+	}
+	return compiled, nil
+}
+
+func (ct *CompiledTarget) Prepare(data map[string]interface{}) (*RequestTarget, error) {
+	body, err := ct.Body(data)
+	if err != nil {
+		return nil, err
+	}
+	uri, err := ct.Uri(data)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := ct.Headers(data)
+	if err != nil {
+		return nil, err
+	}
+	hashKey, err := ct.HashKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestTarget{
+		Name:      ct.Name,
+		Body:      body,
+		Headers:   headers,
+		Verb:      ct.Target.Verb,
+		Uri:       uri,
+		Upstream:  ct.Target.Upstream,
+		HashKey:   hashKey,
+		Transform: ct.Target.Transform,
+	}, nil
+}
+
+func (ct *CompiledTarget) Body(data map[string]interface{}) (string, error) {
+	var buffer bytes.Buffer
+	if err := ct.CompiledBody.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+func (ct *CompiledTarget) Uri(data map[string]interface{}) (string, error) {
+	var buffer bytes.Buffer
+	if err := ct.CompiledUrl.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+func (ct *CompiledTarget) HashKey(data map[string]interface{}) (string, error) {
+	var buffer bytes.Buffer
+	if err := ct.CompiledHashKey.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// StatusCode renders the status code of a stubbed target, defaulting to 200.
+func (ct *CompiledTarget) StatusCode(data map[string]interface{}) (int, error) {
+	if ct.CompiledStatusCode == nil {
+		return http.StatusOK, nil
+	}
+	var buffer bytes.Buffer
+	if err := ct.CompiledStatusCode.Execute(&buffer, data); err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(buffer.String())
+	if len(value) == 0 {
+		return http.StatusOK, nil
+	}
+	statusCode, err := strconv.Atoi(value)
+	if err != nil || statusCode < 100 || statusCode > 999 {
+		return 0, fmt.Errorf("invalid status code %q", value)
+	}
+	return statusCode, nil
+}
+
+// Headers renders the header templates, headers configured with an empty
+// value are copied from the incoming request.
+func (ct *CompiledTarget) Headers(data map[string]interface{}) (map[string]string, error) {
+	headers := map[string]string{}
+	for key, value := range ct.Target.Headers {
+		if len(value) > 0 {
+			var buffer bytes.Buffer
+			if err := ct.CompiledHeaders[key].Execute(&buffer, data); err != nil {
+				return nil, err
+			}
+			headers[key] = buffer.String()
+		} else if headerdata, exists := data["header"].(map[string]interface{}); exists {
+			for k, value := range headerdata {
+				if strings.ToLower(k) == strings.ToLower(key) {
+					if str, isString := value.(string); isString {
+						headers[key] = str
+					} else if strArray, isStringArray := value.([]string); isStringArray {
+						headers[key] = strArray[0]
+					}
+				}
+			}
+		}
+	}
+	return headers, nil
+}
+
+func parseErrorResponse(data map[string]interface{}, statusCode int) *ErrorResponse {
+	response := &ErrorResponse{
+		StatusCode: intOrDefault(data["status_code"], statusCode),
+		Body:       strOrEmpty(data["body"]),
+		Headers:    map[string]string{},
+	}
+	if headers, ok := data["headers"].(map[string]interface{}); ok {
+		for key, v := range headers {
+			response.Headers[key] = v.(string)
+		}
+	}
+	return response
+}
+
+// Fallback answers requests while the circuit breaker of the upstream is
+// open, either with a stale cached response or the configured response.
+type Fallback struct {
+	ServeStale   bool
+	StaleSeconds int
+	Response     *ErrorResponse
+}
+
+func parseFallback(data interface{}) *Fallback {
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	fallback := &Fallback{
+		ServeStale:   boolOrFalse(m["serve_stale"]),
+		StaleSeconds: intOrZero(m["stale_seconds"]),
+	}
+	if _, exists := m["body"]; exists {
+		fallback.Response = parseErrorResponse(m, http.StatusServiceUnavailable)
+	}
+	return fallback
+}
+
+func parseTargetMapping(id string, data map[string]interface{}) (*TargetMapping, error) {
+	transform, err := parseTargetTransform(data["transform"])
+	if err != nil {
+		return nil, err
+	}
+
+	target := &TargetMapping{
+		Headers:   map[string]string{},
+		Verb:      strOrEmpty(data["verb"]),
+		Stub:      boolOrFalse(data["stub"]),
+		Body:      strOrEmpty(data["body"]),
+		Uri:       strOrEmpty(data["uri"]),
+		Upstream:  strOrEmpty(data["upstream"]),
+		HashKey:   strOrEmpty(data["hash_key"]),
+		Transform: transform,
+	}
+	if headers, ok := data["headers"].(map[string]interface{}); ok {
+		for key, v := range headers {
+			target.Headers[key] = v.(string)
+		}
+	}
+	switch code := data["status_code"].(type) {
+	case nil:
+	case string:
+		target.StatusCode = code
+	case float64:
+		target.StatusCode = strconv.Itoa(int(code))
+	default:
+		return nil, fmt.Errorf("invalid status_code of %s, expected a number or a template", id)
+	}
+
+	if steps, ok := data["steps"].([]interface{}); ok {
+		target.Steps = make([]*TargetMapping, 0, len(steps))
+		for i, value := range steps {
+			sub, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid step %s[%d]", id, i)
+			}
+			step, err := parseTargetMapping(id, sub)
+			if err != nil {
+				return nil, err
+			}
+			if step.Name = strOrEmpty(sub["name"]); len(step.Name) == 0 {
+				return nil, fmt.Errorf("step %s[%d] has no name", id, i)
+			}
+			target.Steps = append(target.Steps, step)
+		}
+		if onError, ok := data["on_error"].(map[string]interface{}); ok {
+			target.OnError = parseErrorResponse(onError, http.StatusBadGateway)
+		}
+		if transform == nil || len(transform.Template) == 0 {
+			return nil, fmt.Errorf("chained mapping requires a transform template: %s", id)
+		}
+	}
+
+	if targets, ok := data["targets"].(map[string]interface{}); ok {
+		if len(target.Steps) > 0 {
+			return nil, fmt.Errorf("mapping cannot declare both targets and steps: %s", id)
+		}
+		target.Targets = map[string]*TargetMapping{}
+		for name, value := range targets {
+			if sub, ok := value.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("invalid target %s.%s", id, name)
+			} else if target.Targets[name], err = parseTargetMapping(id, sub); err != nil {
+				return nil, err
+			}
+			target.Targets[name].Name = name
+		}
+		target.FailureMode = strOrEmpty(data["failure_mode"])
+		switch target.FailureMode {
+		case "":
+			target.FailureMode = FailAll
+		case FailAll, BestEffort:
+		default:
+			return nil, fmt.Errorf("unsupported failure mode %s: %s", id, target.FailureMode)
+		}
+		if transform == nil || len(transform.Template) == 0 {
+			return nil, fmt.Errorf("fan-out mapping requires a transform template: %s", id)
+		}
+	}
+
+	return target, nil
+}
@@ -0,0 +1,201 @@
+// Package metrics keeps counters and histograms and exposes them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the latency buckets in seconds used by histograms
+// created without explicit buckets.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var lock = &sync.Mutex{}
+var names = []string{}
+var registry = map[string]metric{}
+
+func register(name string, m metric) {
+	lock.Lock()
+	defer lock.Unlock()
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	names = append(names, name)
+	sort.Strings(names)
+	registry[name] = m
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(name, c)
+	return c
+}
+
+// Inc increments the counter of the given label values by one.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add increments the counter of the given label values by delta.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	key := labelString(c.labels, values)
+	c.lock.Lock()
+	c.values[key] += delta
+	c.lock.Unlock()
+}
+
+// Value returns the current value of the counter of the given label values.
+func (c *CounterVec) Value(values ...string) float64 {
+	key := labelString(c.labels, values)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[key]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	name       string
+	help       string
+	labels     []string
+	buckets    []float64
+	lock       sync.Mutex
+	histograms map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds and
+// label names, DefaultBuckets are used when buckets is nil.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, histograms: map[string]*histogram{}}
+	register(name, h)
+	return h
+}
+
+// Observe adds value to the histogram of the given label values.
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	key := labelString(h.labels, values)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hist, exists := h.histograms[key]
+	if !exists {
+		hist = &histogram{labels: values, counts: make([]uint64, len(h.buckets))}
+		h.histograms[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.histograms[key]
+		labels := append(append([]string{}, h.labels...), "le")
+		for i, bound := range h.buckets {
+			values := append(append([]string{}, hist.labels...), formatFloat(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(labels, values), hist.counts[i])
+		}
+		values := append(append([]string{}, hist.labels...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(labels, values), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+// Handler writes every registered metric in the Prometheus text format.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	lock.Lock()
+	metrics := make([]metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, registry[name])
+	}
+	lock.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func labelString(labels []string, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, label, escaper.Replace(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// StatusClass returns the class of a status code, e.g. "2xx".
+func StatusClass(code int) string {
+	return fmt.Sprintf("%dxx", code/100)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// unregister removes the metrics a test registered so that it can run again.
+func unregister(t *testing.T, metrics ...string) {
+	t.Cleanup(func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, name := range metrics {
+			delete(registry, name)
+			for i, registered := range names {
+				if registered == name {
+					names = append(names[:i], names[i+1:]...)
+					break
+				}
+			}
+		}
+	})
+}
+
+func TestHandler(t *testing.T) {
+	unregister(t, "test_requests_total", "test_latency_seconds")
+	requests := NewCounter("test_requests_total", "Requests.", "mapping", "code")
+	requests.Inc("search", "2xx")
+	requests.Inc("search", "2xx")
+	requests.Inc("quote\"d", "5xx")
+	latency := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "upstream")
+	latency.Observe(0.5, "es")
+
+	recorder := httptest.NewRecorder()
+	Handler(recorder, httptest.NewRequest("GET", "/_metrics", nil))
+	body := recorder.Body.String()
+
+	for _, expected := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{mapping="search",code="2xx"} 2` + "\n",
+		`test_requests_total{mapping="quote\"d",code="5xx"} 1` + "\n",
+		"# TYPE test_latency_seconds histogram\n",
+		`test_latency_seconds_bucket{upstream="es",le="0.1"} 0` + "\n",
+		`test_latency_seconds_bucket{upstream="es",le="1"} 1` + "\n",
+		`test_latency_seconds_bucket{upstream="es",le="+Inf"} 1` + "\n",
+		`test_latency_seconds_sum{upstream="es"} 0.5` + "\n",
+		`test_latency_seconds_count{upstream="es"} 1` + "\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %q in:\n%s", expected, body)
+		}
+	}
+}
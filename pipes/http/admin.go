@@ -0,0 +1,126 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/creamdog/aproxy/cache"
+	"github.com/creamdog/aproxy/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// generationTTL is how long a generation read from the cache is reused, other
+// processes pick up a purge within this time.
+const generationTTL = 5 * time.Second
+
+func generationKey(id string) string {
+	return "generation:" + id
+}
+
+type generationOf struct {
+	cache cache.CacheClient
+	id    string
+}
+
+type knownGeneration struct {
+	value   int64
+	fetched time.Time
+}
+
+var generationsLock = &sync.Mutex{}
+var generations = map[generationOf]knownGeneration{}
+
+// generation returns the cache key generation of a mapping, every cache key
+// of the mapping embeds it so that purging the mapping only has to move the
+// generation forward. Entries of previous generations expire on their own.
+func (pipe *HttpPipe) generation(id string) int64 {
+	of := generationOf{cache: pipe.cache, id: id}
+	generationsLock.Lock()
+	known, exists := generations[of]
+	generationsLock.Unlock()
+	if exists && time.Since(known.fetched) < generationTTL {
+		return known.value
+	}
+
+	var generation int64
+	if _, err := pipe.cache.Get(generationKey(id), &generation); err != nil {
+		log.With(log.Fields{"mapping": id}).Errorf("unable to read cache generation: %v", err)
+		return known.value
+	}
+	pipe.remember(of, generation)
+	return generation
+}
+
+func (pipe *HttpPipe) remember(of generationOf, generation int64) {
+	generationsLock.Lock()
+	defer generationsLock.Unlock()
+	generations[of] = knownGeneration{value: generation, fetched: time.Now()}
+}
+
+// PurgeMapping invalidates every cached response of the mapping.
+func (pipe *HttpPipe) PurgeMapping(id string) (int64, error) {
+	generation := time.Now().UnixNano()
+	if err := pipe.cache.Set(generationKey(id), 0, generation); err != nil {
+		return 0, err
+	}
+	pipe.remember(generationOf{cache: pipe.cache, id: id}, generation)
+	return generation, nil
+}
+
+// CacheAdmin inspects (GET) and purges (DELETE) cache entries. The key
+// parameter takes the key reported in the X-Cache-Key response header, the
+// mapping parameter purges every entry of a mapping and a DELETE without
+// parameters flushes the cache.
+func (pipe *HttpPipe) CacheAdmin(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	id := r.URL.Query().Get("mapping")
+
+	switch {
+	case r.Method == "GET" && len(key) > 0:
+		var cacheResponse CachedResponse
+		if ok, err := pipe.cache.Get(key, &cacheResponse); err != nil {
+			http.Error(w, err.Error(), 500)
+		} else if !ok {
+			http.Error(w, fmt.Sprintf("no cache entry '%s'", key), 404)
+		} else {
+			writeJson(w, map[string]interface{}{
+				"key":                key,
+				"status_code":        cacheResponse.StatusCode,
+				"header":             cacheResponse.Header,
+				"vary":               cacheResponse.Vary,
+				"size":               len(cacheResponse.Body),
+				"expires":            cacheResponse.Expires,
+				"expiration_seconds": int64(cacheResponse.Expires) - time.Now().Unix(),
+			})
+		}
+	case r.Method == "DELETE" && len(key) > 0:
+		log.Infof("purging cache key '%s'", key)
+		if err := pipe.cache.Delete(key); err != nil {
+			http.Error(w, err.Error(), 500)
+		} else {
+			writeJson(w, map[string]interface{}{"purged": key})
+		}
+	case r.Method == "DELETE" && len(id) > 0:
+		log.Infof("purging cache of mapping '%s'", id)
+		if generation, err := pipe.PurgeMapping(id); err != nil {
+			http.Error(w, err.Error(), 500)
+		} else {
+			writeJson(w, map[string]interface{}{"purged": id, "generation": generation})
+		}
+	case r.Method == "DELETE":
+		log.Infof("flushing cache")
+		if err := pipe.cache.FlushAll(); err != nil {
+			http.Error(w, err.Error(), 500)
+		} else {
+			writeJson(w, map[string]interface{}{"flushed": true})
+		}
+	default:
+		http.Error(w, "expected GET with a key or DELETE", 400)
+	}
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,26 @@
+package http
+
+import (
+	"bytes"
+)
+
+// cacheWriter collects a streamed response body for caching. Once the body
+// grows beyond max bytes the collected data is dropped and caching is
+// abandoned, writes never fail so the response itself is unaffected.
+type cacheWriter struct {
+	buffer   bytes.Buffer
+	max      int
+	exceeded bool
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if cw.exceeded {
+		return len(p), nil
+	}
+	if cw.buffer.Len()+len(p) > cw.max {
+		cw.exceeded = true
+		cw.buffer = bytes.Buffer{}
+		return len(p), nil
+	}
+	return cw.buffer.Write(p)
+}
@@ -0,0 +1,63 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/creamdog/aproxy/mappings"
+	"net/http"
+)
+
+// chain calls the mapping steps in order, every step is rendered with the
+// decoded responses of the previous steps available as .data.<name>. The
+// chain stops at the first step that does not succeed.
+func (pipe *HttpPipe) chain(mapping *mappings.RequestMapping, w http.ResponseWriter) {
+	data := map[string]interface{}{}
+	status := map[string]interface{}{}
+
+	values := map[string]interface{}{}
+	for key, value := range *mapping.Data {
+		values[key] = value
+	}
+	values["data"] = data
+	values["status"] = status
+
+	for _, step := range mapping.Steps {
+		response := pipe.call(mapping, step, values)
+		status[response.Name] = response.Status()
+		if !response.Ok() {
+			mapping.Log.Warnf("step %v failed: %v", response.Name, response.Error())
+			if fallsBack(mapping, response) {
+				pipe.fallback(mapping, w)
+				return
+			}
+			values["failed"] = response.Name
+			pipe.chainError(mapping, w, response, values)
+			return
+		}
+		data[response.Name] = response.Data
+	}
+
+	pipe.respond(mapping, w, map[string]interface{}{
+		"data":   data,
+		"status": status,
+	})
+}
+
+func (pipe *HttpPipe) chainError(mapping *mappings.RequestMapping, w http.ResponseWriter, response *TargetResponse, values map[string]interface{}) {
+	onError := mapping.Mapping.Target.OnError
+	if onError == nil || mapping.CompiledOnError == nil {
+		http.Error(w, fmt.Sprintf("step %s: %s", response.Name, response.Error()), 502)
+		return
+	}
+
+	var buffer bytes.Buffer
+	if err := mapping.CompiledOnError.Execute(&buffer, values); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	for key, value := range onError.Headers {
+		w.Header().Set(key, value)
+	}
+	w.WriteHeader(onError.StatusCode)
+	fmt.Fprint(w, buffer.String())
+}
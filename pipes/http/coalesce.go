@@ -0,0 +1,119 @@
+package http
+
+import (
+	"github.com/creamdog/aproxy/mappings"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// passDuration is how long requests for a key whose response could not be
+	// cached skip coalescing and go upstream in parallel
+	passDuration = 10 * time.Second
+	// maxPasses is the number of passing keys kept before expired ones are
+	// dropped
+	maxPasses = 10000
+)
+
+// coalescer tracks the upstream requests in flight per cache key so that
+// concurrent cache misses result in a single upstream request.
+type coalescer struct {
+	lock   sync.Mutex
+	calls  map[string]*sync.WaitGroup
+	passes map[string]time.Time
+}
+
+var flights = &coalescer{calls: map[string]*sync.WaitGroup{}, passes: map[string]time.Time{}}
+
+// acquire registers a request for key, when one is already in flight its wait
+// group is returned instead and the caller is not the leader.
+func (c *coalescer) acquire(key string) (*sync.WaitGroup, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if wg, exists := c.calls[key]; exists {
+		return wg, false
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	c.calls[key] = wg
+	return wg, true
+}
+
+// release ends the flight wg of key, unless pass already ended it.
+func (c *coalescer) release(key string, wg *sync.WaitGroup) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.calls[key] == wg {
+		delete(c.calls, key)
+		wg.Done()
+	}
+}
+
+// pass records that the response for key could not be cached, the requests
+// waiting for it are released at once and later requests skip coalescing for
+// passDuration.
+func (c *coalescer) pass(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if len(c.passes) >= maxPasses {
+		for k, until := range c.passes {
+			if now.After(until) {
+				delete(c.passes, k)
+			}
+		}
+	}
+	c.passes[key] = now.Add(passDuration)
+	if wg, exists := c.calls[key]; exists {
+		delete(c.calls, key)
+		wg.Done()
+	}
+}
+
+// passing reports whether requests for key skip coalescing.
+func (c *coalescer) passing(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	until, exists := c.passes[key]
+	if exists && time.Now().After(until) {
+		delete(c.passes, key)
+		return false
+	}
+	return exists
+}
+
+// refresh fetches a stale cache entry again in the background, unless a
+// request for the same key is already in flight.
+func (pipe *HttpPipe) refresh(mapping *mappings.RequestMapping) {
+	inflight, leader := flights.acquire(mapping.CacheKey)
+	if !leader {
+		return
+	}
+	refreshed := *mapping
+	refreshed.RequestStream = ioutil.NopCloser(strings.NewReader(""))
+	background := &HttpPipe{cache: pipe.cache}
+	go func() {
+		defer flights.release(refreshed.CacheKey, inflight)
+		refreshed.Log.Debugf("refreshing '%s'", refreshed.CacheKey)
+		background.fetch(&refreshed, &discardWriter{header: http.Header{}}, false)
+	}()
+}
+
+// discardWriter is the response writer of background refreshes.
+type discardWriter struct {
+	header http.Header
+}
+
+func (dw *discardWriter) Header() http.Header {
+	return dw.header
+}
+
+func (dw *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (dw *discardWriter) WriteHeader(statusCode int) {
+}
@@ -0,0 +1,52 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/creamdog/aproxy/mappings"
+	upstreams "github.com/creamdog/aproxy/upstream"
+	"net/http"
+)
+
+// fallsBack reports whether a failed fan-out target or chain step was
+// rejected by an open circuit breaker of a mapping with a fallback.
+func fallsBack(mapping *mappings.RequestMapping, response *TargetResponse) bool {
+	return response.Err == upstreams.ErrCircuitOpen && mapping.Mapping.Fallback != nil
+}
+
+// fallback answers a request whose upstream circuit breaker is open with a
+// stale cached response when allowed and available, otherwise with the
+// rendered fallback response.
+func (pipe *HttpPipe) fallback(mapping *mappings.RequestMapping, w http.ResponseWriter) {
+	fallback := mapping.Mapping.Fallback
+	w.Header().Set("X-AProxy-Fallback", "true")
+
+	if fallback.ServeStale && len(mapping.CacheKey) > 0 {
+		var cacheResponse CachedResponse
+		if ok, err := pipe.lookup(mapping, &cacheResponse); ok {
+			mapping.Log.Warnf("circuit open, serving stale '%s'", mapping.CacheKey)
+			w.Header().Set("X-Cache-Stale", "true")
+			writeCached(w, &cacheResponse)
+			return
+		} else if err != nil {
+			mapping.Log.Errorf("%v", err)
+		}
+	}
+
+	if fallback.Response == nil || mapping.CompiledFallback == nil {
+		http.Error(w, "circuit breaker open", http.StatusServiceUnavailable)
+		return
+	}
+
+	var buffer bytes.Buffer
+	if err := mapping.CompiledFallback.Execute(&buffer, *mapping.Data); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	mapping.Log.Warnf("circuit open, serving fallback response")
+	for key, value := range fallback.Response.Headers {
+		w.Header().Set(key, value)
+	}
+	w.WriteHeader(fallback.Response.StatusCode)
+	fmt.Fprint(w, buffer.String())
+}
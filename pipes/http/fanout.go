@@ -0,0 +1,73 @@
+package http
+
+import (
+	"fmt"
+	"github.com/creamdog/aproxy/mappings"
+	"net/http"
+	"sync"
+)
+
+// fanOut calls every named target of the mapping concurrently and renders the
+// transform with the decoded responses available as .data.<name> and the
+// per target outcome as .status.<name>.
+func (pipe *HttpPipe) fanOut(mapping *mappings.RequestMapping, w http.ResponseWriter) {
+	responses := make([]*TargetResponse, len(mapping.Targets))
+	var wg sync.WaitGroup
+	for i, target := range mapping.Targets {
+		wg.Add(1)
+		go func(i int, target *mappings.CompiledTarget) {
+			defer wg.Done()
+			responses[i] = pipe.call(mapping, target, *mapping.Data)
+		}(i, target)
+	}
+	wg.Wait()
+
+	data := map[string]interface{}{}
+	status := map[string]interface{}{}
+	for _, response := range responses {
+		status[response.Name] = response.Status()
+		if !response.Ok() {
+			mapping.Log.Warnf("target %v failed: %v", response.Name, response.Error())
+			if mapping.Mapping.Target.FailureMode != mappings.BestEffort {
+				if fallsBack(mapping, response) {
+					pipe.fallback(mapping, w)
+					return
+				}
+				http.Error(w, fmt.Sprintf("target %s: %s", response.Name, response.Error()), 502)
+				return
+			}
+			continue
+		}
+		data[response.Name] = response.Data
+	}
+
+	pipe.respond(mapping, w, map[string]interface{}{
+		"data":   data,
+		"status": status,
+	})
+}
+
+// respond renders the mapping transform with values, caches the result and
+// writes it with the transform headers.
+func (pipe *HttpPipe) respond(mapping *mappings.RequestMapping, w http.ResponseWriter, values map[string]interface{}) {
+	responseBody, err := render(mapping, values)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	header := http.Header{}
+	for key, value := range mapping.Mapping.Target.Transform.Headers {
+		if len(value) > 0 {
+			header.Set(key, value)
+		}
+	}
+	for key, value := range header {
+		w.Header()[key] = value
+	}
+
+	pipe.store(mapping, header, http.StatusOK, responseBody)
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, responseBody)
+}
@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/creamdog/aproxy/accesslog"
 	"github.com/creamdog/aproxy/cache"
 	"github.com/creamdog/aproxy/mappings"
+	"github.com/creamdog/aproxy/metrics"
+	"github.com/creamdog/aproxy/tracing"
+	upstreams "github.com/creamdog/aproxy/upstream"
 	"io"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
@@ -15,6 +19,10 @@ import (
 
 type HttpPipe struct {
 	cache cache.CacheClient
+	// entry is the access log entry of the request being piped
+	entry *accesslog.Entry
+	// span is the trace span of the request being piped
+	span *tracing.Span
 }
 
 type CachedResponse struct {
@@ -23,6 +31,7 @@ type CachedResponse struct {
 	Body       string
 	Expires    int
 	Key        string
+	Vary       []string
 }
 
 func New(cacheClient cache.CacheClient) *HttpPipe {
@@ -33,67 +42,133 @@ func New(cacheClient cache.CacheClient) *HttpPipe {
 
 func (pipe *HttpPipe) Pipe(mapping *mappings.RequestMapping, w http.ResponseWriter) {
 
-	log.Printf("%v %v, %v, cacheKey: %s", mapping.Verb, mapping.Uri, mapping.Headers, mapping.CacheKey)
+	mapping.Log.Debugf("%v %v, %v, cacheKey: %s", mapping.Verb, mapping.Uri, mapping.Headers, mapping.CacheKey)
+
+	pipe.entry = accesslog.From(w)
+	pipe.span = tracing.From(w)
+	pipe.entry.Mapping(mapping.Id)
+
+	recorder := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		requestsTotal.Inc(mapping.Id, metrics.StatusClass(recorder.Status()))
+	}()
+	w = recorder
 
 	w.Header().Set("X-AProxy-Version", "0.1")
+	if !pipe.limit(mapping, w) {
+		return
+	}
 	_, notransform := (*mapping.Data)["query"].(map[string]interface{})["_notransform"]
 	_, nocache := (*mapping.Data)["query"].(map[string]interface{})["_nocache"]
 
-	maxBodySize := 1 * 1024 * 1024
-
 	if nocache {
 		mapping.CacheKey = ""
+	} else if len(mapping.CacheKey) > 0 {
+		mapping.CacheKey = fmt.Sprintf("%s#%d", mapping.CacheKey, pipe.generation(mapping.Id))
 	}
 
-	if len(mapping.CacheKey) > 0 {
-		var cacheResponse CachedResponse
-		if ok, err := pipe.cache.Get(mapping.CacheKey, &cacheResponse); ok {
-			log.Printf("cache hit: %v", mapping.CacheKey)
-			for key, value := range cacheResponse.Header {
-				if key == "Content-Length" {
-					w.Header().Set("Content-Length", fmt.Sprintf("%d", len(cacheResponse.Body)))
-				} else {
-					w.Header().Set(key, value[0])
-				}
-			}
-
-			w.Header().Set("X-Cache-Hit", "true")
-			w.Header().Set("X-Cache-Key", cacheResponse.Key)
-			w.Header().Set("X-Cache-Expiration-Seconds", fmt.Sprintf("%d", int64(cacheResponse.Expires)-time.Now().Unix()))
+	if pipe.serveCached(mapping, w) {
+		return
+	}
 
-			w.WriteHeader(cacheResponse.StatusCode)
-			fmt.Fprint(w, cacheResponse.Body)
+	// requests for keys that were recently uncacheable are not coalesced,
+	// waiting would only serialize them
+	for len(mapping.CacheKey) > 0 && !flights.passing(mapping.CacheKey) {
+		inflight, leader := flights.acquire(mapping.CacheKey)
+		if leader {
+			defer flights.release(mapping.CacheKey, inflight)
+			break
+		}
+		mapping.Log.Debugf("waiting for in-flight request '%s'", mapping.CacheKey)
+		inflight.Wait()
+		if pipe.serveCached(mapping, w) {
 			return
-		} else if err != nil {
-			log.Printf("%v", err)
-		} else {
-			log.Printf("cache miss '%s'", mapping.CacheKey)
 		}
 	}
 
-	reqstream := io.Reader(strings.NewReader(mapping.Body))
+	pipe.fetch(mapping, w, notransform)
+}
+
+// fetch performs the upstream request(s) of the mapping and writes the
+// response, caching it when the mapping has a cache key.
+func (pipe *HttpPipe) fetch(mapping *mappings.RequestMapping, w http.ResponseWriter, notransform bool) {
+	if mapping.Mapping.Target.Stub {
+		pipe.stub(mapping, w)
+		return
+	}
+
+	if len(mapping.Targets) > 0 {
+		pipe.fanOut(mapping, w)
+		return
+	}
+
+	if len(mapping.Steps) > 0 {
+		pipe.chain(mapping, w)
+		return
+	}
+
+	body := mapping.Body
+	retry := mapping.Mapping.Retry
+	var reqstream io.Reader
 	if len(mapping.Mapping.Target.Body) == 0 {
 		defer mapping.RequestStream.Close()
 		reqstream = io.Reader(mapping.RequestStream)
+		// retried requests replay a buffered copy of the incoming body,
+		// bodies too large to buffer are streamed and not retried
+		if retry.Attempts(mapping.Verb) > 1 {
+			buffer, err := ioutil.ReadAll(io.LimitReader(mapping.RequestStream, mappings.DefaultMaxBodySize+1))
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if len(buffer) > mappings.DefaultMaxBodySize {
+				mapping.Log.Infof("request body exceeds %d bytes, not retrying", mappings.DefaultMaxBodySize)
+				reqstream, retry = io.MultiReader(bytes.NewReader(buffer), mapping.RequestStream), nil
+			} else {
+				body, reqstream = string(buffer), nil
+			}
+		}
 	}
 
-	request, err := http.NewRequest(mapping.Verb, mapping.Uri, reqstream)
+	u, err := upstreams.Get(mapping.Mapping.Target.Upstream)
 	if err != nil {
-		http.Error(w, err.Error(), 503)
+		http.Error(w, err.Error(), 502)
+		return
 	}
-	request.ContentLength = int64(len(mapping.Body))
 
-	//log.Printf("request.ContentLength: %d, mapping.Body: %v", request.ContentLength, mapping.Body)
+	started := time.Now()
+	response, attempts, err := pipe.do(mapping.Log, u, retry, mapping.Verb, mapping.HashKey, func() (*http.Request, error) {
+		stream := reqstream
+		if stream == nil {
+			stream = strings.NewReader(body)
+		}
+		request, err := http.NewRequest(mapping.Verb, mapping.Uri, stream)
+		if err != nil {
+			return nil, err
+		}
+		request.ContentLength = int64(len(body))
 
-	for key, value := range mapping.Headers {
-		request.Header[key] = []string{value}
-	}
+		//log.Debugf("request.ContentLength: %d, mapping.Body: %v", request.ContentLength, mapping.Body)
 
-	request.Header["Transfer-Encoding"] = []string{""}
+		for key, value := range mapping.Headers {
+			request.Header[key] = []string{value}
+		}
+		forwardRequestId(mapping, request)
+
+		request.Header["Transfer-Encoding"] = []string{""}
+		return request, nil
+	})
+	w.Header().Set("X-AProxy-Attempts", fmt.Sprintf("%d", attempts))
+	if err == nil {
+		pipe.entry.Upstream(mapping.Uri, response.StatusCode, started)
+	} else if err != upstreams.ErrCircuitOpen {
+		pipe.entry.Upstream(mapping.Uri, 0, started)
+	}
 
-	client := &http.Client{}
-	if response, err := client.Do(request); err != nil {
-		http.Error(w, err.Error(), 500)
+	if err == upstreams.ErrCircuitOpen && mapping.Mapping.Fallback != nil {
+		pipe.fallback(mapping, w)
+	} else if err != nil {
+		http.Error(w, err.Error(), 502)
 	} else {
 
 		defer response.Body.Close()
@@ -101,93 +176,37 @@ func (pipe *HttpPipe) Pipe(mapping *mappings.RequestMapping, w http.ResponseWrit
 		responseBody := ""
 		responseBodyRead := false
 
-		readResponseBody := func() ([]byte, error) {
-			responseBodyRead = true
-			readBuffer := make([]byte, 1024)
-			buffer := make([]byte, 0)
-			read := true
-			//max := 1 * 1024 * 1024
-			for read {
-
-				if len(buffer) > maxBodySize {
-
-				}
-
-				/*
-					if len(buffer) >= max {
-						http.Error(w, fmt.Errorf("transform: maximum input site exceeded %d bytes", max).Error(), 500)
-						return
-					}
-				*/
-				read = false
-				num, err := response.Body.Read(readBuffer)
-				if err != nil {
-					if err.Error() == "EOF" {
-						buffer = append(buffer, readBuffer[:num]...)
-						break
-					}
-					return nil, err
-				}
-				//log.Printf("read %d bytes", num)
-				if num > 0 {
-					buffer = append(buffer, readBuffer[:num]...)
-					read = true
-				}
-			}
-			return buffer, nil
-		}
-
 		if mapping.CompiledTransform != nil && !notransform && response.StatusCode == 200 {
 
-			buffer, err := readResponseBody()
+			maxInputSize := mapping.Mapping.Target.Transform.MaxInputSize
+			buffer, err := ioutil.ReadAll(io.LimitReader(response.Body, int64(maxInputSize)+1))
 			if err != nil {
-				http.Error(w, err.Error(), 500)
+				http.Error(w, err.Error(), 502)
+				return
 			}
-
-			//log.Printf("buffer[%d]: %v", len(buffer), string(buffer))
-
-			responseData := map[string]interface{}{}
-
-			if mapping.Mapping.Target.Transform.Type == "json" {
-				if err := json.Unmarshal(buffer, &responseData); err != nil {
-					http.Error(w, err.Error()+" : "+string(buffer), 500)
-					return
-				}
-			} else if mapping.Mapping.Target.Transform.Type == "regexp" {
-				re := mapping.Mapping.Target.Transform.Regexp.FindStringSubmatch(string(buffer))
-				names := mapping.Mapping.Target.Transform.Regexp.SubexpNames()
-				if re != nil {
-					for i, n := range re {
-						if len(names[i]) > 0 {
-							responseData[names[i]] = n
-						}
-					}
-				}
+			if len(buffer) > maxInputSize {
+				http.Error(w, fmt.Sprintf("transform: maximum input size exceeded %d bytes", maxInputSize), 502)
+				return
 			}
+			responseBodyRead = true
 
-			//log.Printf("responseData: %v", responseData)
+			//log.Debugf("buffer[%d]: %v", len(buffer), string(buffer))
 
-			data := map[string]interface{}{
-				"data": responseData,
-			}
-			for key, value := range *mapping.Data {
-				data[key] = value
-			}
-
-			var renderBuffer bytes.Buffer
-			if err := mapping.CompiledTransform.Execute(&renderBuffer, data); err != nil {
-				http.Error(w, err.Error(), 500)
+			responseData, err := decode(mapping.Mapping.Target.Transform, buffer)
+			if err != nil {
+				http.Error(w, err.Error()+" : "+string(buffer), 500)
 				return
 			}
-			responseBody = renderBuffer.String()
-		}
 
-		if len(mapping.CacheKey) > 0 && !responseBodyRead {
-			buffer, err := readResponseBody()
+			//log.Debugf("responseData: %v", responseData)
+
+			responseBody, err = render(mapping, map[string]interface{}{
+				"data": responseData,
+			})
 			if err != nil {
 				http.Error(w, err.Error(), 500)
+				return
 			}
-			responseBody = string(buffer)
 		}
 
 		for key, value := range response.Header {
@@ -239,20 +258,188 @@ func (pipe *HttpPipe) Pipe(mapping *mappings.RequestMapping, w http.ResponseWrit
 
 		if responseBodyRead {
 
-			if len(mapping.CacheKey) > 0 {
-				cachedResponse := CachedResponse{
-					Header:     response.Header,
-					StatusCode: response.StatusCode,
-					Body:       responseBody,
-					Expires:    int(time.Now().Unix()) + mapping.Mapping.Caching.Seconds,
-					Key:        mapping.CacheKey,
-				}
-				pipe.cache.Set(mapping.CacheKey, cachedResponse.Expires, cachedResponse)
-			}
+			pipe.store(mapping, response.Header, response.StatusCode, responseBody)
 
 			fmt.Fprint(w, responseBody)
+		} else if _, cacheable := ttl(mapping.Mapping.Caching, response.StatusCode, response.Header); len(mapping.CacheKey) > 0 && cacheable {
+			cw := &cacheWriter{max: mapping.Mapping.Caching.MaxSize}
+			if _, err := io.Copy(w, io.TeeReader(response.Body, cw)); err != nil {
+				mapping.Log.Warnf("not caching interrupted response: %v", err)
+			} else if cw.exceeded {
+				mapping.Log.Infof("not caching response exceeding %d bytes", cw.max)
+				flights.pass(mapping.CacheKey)
+			} else {
+				pipe.store(mapping, response.Header, response.StatusCode, cw.buffer.String())
+			}
 		} else {
+			if len(mapping.CacheKey) > 0 {
+				flights.pass(mapping.CacheKey)
+			}
 			io.Copy(w, response.Body)
 		}
 	}
 }
+
+func (pipe *HttpPipe) serveCached(mapping *mappings.RequestMapping, w http.ResponseWriter) bool {
+	if len(mapping.CacheKey) == 0 {
+		return false
+	}
+
+	var cacheResponse CachedResponse
+	ok, err := pipe.lookup(mapping, &cacheResponse)
+	if expired := int64(cacheResponse.Expires) < time.Now().Unix(); ok && expired {
+		if int64(cacheResponse.Expires+mapping.Mapping.Caching.StaleSeconds) < time.Now().Unix() {
+			mapping.Log.Debugf("cache expired '%s'", mapping.CacheKey)
+			cacheRequests.Inc(mapping.Id, "miss")
+			pipe.entry.Cache("miss")
+			return false
+		}
+		mapping.Log.Debugf("serving stale '%s'", mapping.CacheKey)
+		w.Header().Set("X-Cache-Stale", "true")
+		cacheRequests.Inc(mapping.Id, "stale")
+		pipe.entry.Cache("stale")
+		pipe.refresh(mapping)
+	} else if ok {
+		cacheRequests.Inc(mapping.Id, "hit")
+		pipe.entry.Cache("hit")
+	}
+	if ok {
+		mapping.Log.Debugf("cache hit: %v", mapping.CacheKey)
+		writeCached(w, &cacheResponse)
+		return true
+	} else if err != nil {
+		mapping.Log.Errorf("cache lookup failed: %v", err)
+		cacheRequests.Inc(mapping.Id, "error")
+	} else {
+		mapping.Log.Debugf("cache miss '%s'", mapping.CacheKey)
+		cacheRequests.Inc(mapping.Id, "miss")
+		pipe.entry.Cache("miss")
+	}
+	return false
+}
+
+func writeCached(w http.ResponseWriter, cacheResponse *CachedResponse) {
+	for key, value := range cacheResponse.Header {
+		if key == "Content-Length" {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(cacheResponse.Body)))
+		} else {
+			w.Header().Set(key, value[0])
+		}
+	}
+
+	w.Header().Set("X-Cache-Hit", "true")
+	w.Header().Set("X-Cache-Key", cacheResponse.Key)
+	w.Header().Set("X-Cache-Expiration-Seconds", fmt.Sprintf("%d", int64(cacheResponse.Expires)-time.Now().Unix()))
+
+	w.WriteHeader(cacheResponse.StatusCode)
+	fmt.Fprint(w, cacheResponse.Body)
+}
+
+// lookup reads the cached response of the mapping, following the vary index
+// entry stored under the plain cache key when the upstream response varied.
+func (pipe *HttpPipe) lookup(mapping *mappings.RequestMapping, cacheResponse *CachedResponse) (bool, error) {
+	ok, err := pipe.cacheGet(mapping.CacheKey, cacheResponse)
+	if !ok || len(cacheResponse.Vary) == 0 {
+		return ok, err
+	}
+	key := varyKey(mapping.CacheKey, cacheResponse.Vary, *mapping.Data)
+	*cacheResponse = CachedResponse{}
+	return pipe.cacheGet(key, cacheResponse)
+}
+
+func (pipe *HttpPipe) cacheGet(key string, v interface{}) (bool, error) {
+	span := pipe.span.Child("cache.get", tracing.KindClient)
+	defer span.Finish()
+	span.SetAttribute("cache.key", key)
+	ok, err := pipe.cache.Get(key, v)
+	span.SetAttribute("cache.hit", ok)
+	span.SetError(err)
+	return ok, err
+}
+
+func (pipe *HttpPipe) cacheSet(key string, expiration int, v interface{}) error {
+	span := pipe.span.Child("cache.set", tracing.KindClient)
+	defer span.Finish()
+	span.SetAttribute("cache.key", key)
+	err := pipe.cache.Set(key, expiration, v)
+	span.SetError(err)
+	return err
+}
+
+func (pipe *HttpPipe) store(mapping *mappings.RequestMapping, header http.Header, statusCode int, body string) {
+	if len(mapping.CacheKey) == 0 {
+		return
+	}
+	seconds, cacheable := ttl(mapping.Mapping.Caching, statusCode, header)
+	if !cacheable {
+		mapping.Log.Debugf("response %d not cacheable", statusCode)
+		flights.pass(mapping.CacheKey)
+		return
+	}
+
+	key := mapping.CacheKey
+	expires := int(time.Now().Unix()) + seconds
+	// keep entries past their expiry for as long as they may be served stale
+	retain := expires + mapping.Mapping.Caching.StaleSeconds
+	if fallback := mapping.Mapping.Fallback; fallback != nil && fallback.ServeStale && fallback.StaleSeconds > mapping.Mapping.Caching.StaleSeconds {
+		retain = expires + fallback.StaleSeconds
+	}
+	if mapping.Mapping.Caching.Vary {
+		if vary := varyHeaders(header); len(vary) > 0 {
+			pipe.cacheSet(key, retain, CachedResponse{Expires: expires, Key: key, Vary: vary})
+			key = varyKey(key, vary, *mapping.Data)
+		}
+	}
+
+	cachedResponse := CachedResponse{
+		Header:     header,
+		StatusCode: statusCode,
+		Body:       body,
+		Expires:    expires,
+		Key:        key,
+	}
+	if err := pipe.cacheSet(key, retain, cachedResponse); err != nil {
+		mapping.Log.Errorf("caching failed: %v", err)
+		cacheRequests.Inc(mapping.Id, "error")
+	}
+}
+
+// decode parses an upstream response body according to the transform type,
+// json bodies are unmarshalled and regexp bodies yield their named groups.
+func decode(transform *mappings.TargetTransform, buffer []byte) (map[string]interface{}, error) {
+	responseData := map[string]interface{}{}
+	if transform == nil || transform.Type == "json" {
+		if err := json.Unmarshal(buffer, &responseData); err != nil {
+			return nil, err
+		}
+	} else if transform.Type == "regexp" && transform.Regexp != nil {
+		re := transform.Regexp.FindStringSubmatch(string(buffer))
+		names := transform.Regexp.SubexpNames()
+		if re != nil {
+			for i, n := range re {
+				if len(names[i]) > 0 {
+					responseData[names[i]] = n
+				}
+			}
+		}
+	}
+	return responseData, nil
+}
+
+// render executes the mapping transform with the given values merged into
+// the request data.
+func render(mapping *mappings.RequestMapping, values map[string]interface{}) (string, error) {
+	data := map[string]interface{}{}
+	for key, value := range values {
+		data[key] = value
+	}
+	for key, value := range *mapping.Data {
+		data[key] = value
+	}
+
+	var renderBuffer bytes.Buffer
+	if err := mapping.CompiledTransform.Execute(&renderBuffer, data); err != nil {
+		return "", err
+	}
+	return renderBuffer.String(), nil
+}
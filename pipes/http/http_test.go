@@ -0,0 +1,621 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/creamdog/aproxy/cache"
+	"github.com/creamdog/aproxy/cache/memory"
+	"github.com/creamdog/aproxy/mappings"
+	upstreams "github.com/creamdog/aproxy/upstream"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func upstream(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func prepare(t *testing.T, config string, path string) *mappings.RequestMapping {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(config), &data); err != nil {
+		t.Fatal(err)
+	}
+	list, err := mappings.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm, err := list.GetMatch(map[string]interface{}{
+		"request": map[string]interface{}{
+			"method": "GET",
+			"path":   path,
+			"body":   ioutil.NopCloser(strings.NewReader("")),
+		},
+		"query":  map[string]interface{}{},
+		"header": map[string]interface{}{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rm == nil {
+		t.Fatalf("no mapping matched %s", path)
+	}
+	return rm
+}
+
+func TestFanOut(t *testing.T) {
+	search := upstream(200, `{"hits": 3}`)
+	defer search.Close()
+	profile := upstream(503, `unavailable`)
+	defer profile.Close()
+
+	config := `{
+		"aggregate" : {
+			"target" : {
+				"failure_mode" : "%s",
+				"targets" : {
+					"search" : {"verb" : "GET", "uri" : "%s"},
+					"profile" : {"verb" : "GET", "uri" : "%s"}
+				},
+				"transform" : {
+					"type" : "json",
+					"template" : "{{.data.search.hits}} {{.status.profile.status_code}}"
+				}
+			},
+			"mapping" : {"request.path" : "^/aggregate$"}
+		}
+	}`
+
+	w := httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(prepare(t, fmt.Sprintf(config, "best_effort", search.URL, profile.URL), "/aggregate"), w)
+	if w.Code != 200 || w.Body.String() != "3 503" {
+		t.Errorf("best effort: %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(prepare(t, fmt.Sprintf(config, "fail_all", search.URL, profile.URL), "/aggregate"), w)
+	if w.Code != 502 {
+		t.Errorf("fail all: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestChain(t *testing.T) {
+	lookup := upstream(200, `{"id": 7}`)
+	defer lookup.Close()
+	details := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/users/7" {
+			w.WriteHeader(404)
+			return
+		}
+		fmt.Fprint(w, `{"name": "creamdog"}`)
+	}))
+	defer details.Close()
+
+	config := `{
+		"chain" : {
+			"target" : {
+				"steps" : [
+					{"name" : "lookup", "verb" : "GET", "uri" : "%s"},
+					{"name" : "details", "verb" : "GET", "uri" : "%s/users/{{.data.lookup.id}}{{.match.suffix}}"}
+				],
+				"on_error" : {"status_code" : 424, "body" : "{{.failed}} {{.status.details.status_code}}"},
+				"transform" : {"template" : "{{.data.details.name}}"}
+			},
+			"mapping" : {"request.path" : "^/chain(?P<suffix>.*)$"}
+		}
+	}`
+
+	w := httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(prepare(t, fmt.Sprintf(config, lookup.URL, details.URL), "/chain"), w)
+	if w.Code != 200 || w.Body.String() != "creamdog" {
+		t.Errorf("chain: %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(prepare(t, fmt.Sprintf(config, lookup.URL, details.URL), "/chain/missing"), w)
+	if w.Code != 424 || w.Body.String() != "details 404" {
+		t.Errorf("chain error: %d %q", w.Code, w.Body.String())
+	}
+}
+
+type recordingCache struct {
+	cache.NoopClient
+	keys []string
+}
+
+func (rc *recordingCache) Set(key string, expiration int, v interface{}) error {
+	rc.keys = append(rc.keys, key)
+	return nil
+}
+
+func TestStreamedCaching(t *testing.T) {
+	server := upstream(200, `0123456789`)
+	defer server.Close()
+
+	config := `{
+		"stream" : {
+			"target" : {"verb" : "GET", "uri" : "%s"},
+			"mapping" : {"request.path" : "^/stream$"},
+			"cache_strategy" : {"key" : "k", "duration_seconds" : 10, "max_size_bytes" : %d}
+		}
+	}`
+
+	for max, cached := range map[int]bool{10: true, 9: false} {
+		rc := &recordingCache{}
+		w := httptest.NewRecorder()
+		New(rc).Pipe(prepare(t, fmt.Sprintf(config, server.URL, max), "/stream"), w)
+		if w.Body.String() != "0123456789" {
+			t.Errorf("max %d: unexpected body %q", max, w.Body.String())
+		}
+		if (len(rc.keys) > 0) != cached {
+			t.Errorf("max %d: expected cached %v, got %v", max, cached, rc.keys)
+		}
+	}
+}
+
+func TestTransformInputLimit(t *testing.T) {
+	server := upstream(200, `{"value" : "0123456789"}`)
+	defer server.Close()
+
+	rm := prepare(t, fmt.Sprintf(`{
+		"limited" : {
+			"target" : {
+				"verb" : "GET",
+				"uri" : "%s",
+				"transform" : {"template" : "{{.data.value}}", "max_input_bytes" : 8}
+			},
+			"mapping" : {"request.path" : "^/limited$"}
+		}
+	}`, server.URL), "/limited")
+
+	w := httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(rm, w)
+	if w.Code != 502 {
+		t.Errorf("expected 502, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	strategy := &mappings.CacheStrategy{Seconds: 60, StatusCodes: []int{200, 404}, CacheControl: true}
+	for _, test := range []struct {
+		status  int
+		header  http.Header
+		seconds int
+		ok      bool
+	}{
+		{200, http.Header{}, 60, true},
+		{404, http.Header{}, 60, true},
+		{500, http.Header{}, 0, false},
+		{200, http.Header{"Cache-Control": {"public, max-age=30"}}, 30, true},
+		{200, http.Header{"Cache-Control": {"max-age=30, s-maxage=10"}}, 10, true},
+		{200, http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{200, http.Header{"Cache-Control": {"private, max-age=30"}}, 0, false},
+		{200, http.Header{"Expires": {"0"}}, 0, false},
+	} {
+		seconds, ok := ttl(strategy, test.status, test.header)
+		if seconds != test.seconds || ok != test.ok {
+			t.Errorf("%d %v: expected %d %v, got %d %v", test.status, test.header, test.seconds, test.ok, seconds, ok)
+		}
+	}
+
+	key := varyKey("k", varyHeaders(http.Header{"Vary": {"Accept-Encoding, Accept"}}), map[string]interface{}{
+		"header": map[string]interface{}{"accept-encoding": "gzip"},
+	})
+	if key != "k|accept=|accept-encoding=gzip" {
+		t.Errorf("unexpected vary key: %s", key)
+	}
+}
+
+type memoryCache struct {
+	sync.Mutex
+	entries map[string][]byte
+}
+
+func (mc *memoryCache) Get(key string, v interface{}) (bool, error) {
+	mc.Lock()
+	defer mc.Unlock()
+	if bytes, exists := mc.entries[key]; exists {
+		return true, json.Unmarshal(bytes, v)
+	}
+	return false, nil
+}
+
+func (mc *memoryCache) Set(key string, expiration int, v interface{}) error {
+	mc.Lock()
+	defer mc.Unlock()
+	bytes, err := json.Marshal(v)
+	mc.entries[key] = bytes
+	return err
+}
+
+func (mc *memoryCache) Delete(key string) error { return nil }
+func (mc *memoryCache) FlushAll() error         { return nil }
+
+func TestCoalescing(t *testing.T) {
+	var hits int32
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		fmt.Fprint(w, "fresh")
+	}))
+	defer server.Close()
+
+	config := fmt.Sprintf(`{
+		"popular" : {
+			"target" : {"verb" : "GET", "uri" : "%s"},
+			"mapping" : {"request.path" : "^/popular$"},
+			"cache_strategy" : {"key" : "k", "duration_seconds" : 10, "stale_seconds" : 60}
+		}
+	}`, server.URL)
+
+	mc := &memoryCache{entries: map[string][]byte{}}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			New(mc).Pipe(prepare(t, config, "/popular"), w)
+			if w.Body.String() != "fresh" {
+				t.Errorf("unexpected body %q", w.Body.String())
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("expected a single upstream request, got %d", hits)
+	}
+
+	mc.Set("popular:k#0", 0, CachedResponse{StatusCode: 200, Body: "stale", Expires: int(time.Now().Unix()) - 5, Key: "popular:k#0"})
+	w := httptest.NewRecorder()
+	New(mc).Pipe(prepare(t, config, "/popular"), w)
+	if w.Body.String() != "stale" || w.Header().Get("X-Cache-Stale") != "true" {
+		t.Errorf("expected stale response, got %q", w.Body.String())
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&hits) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("expected a background refresh, got %d upstream requests", hits)
+	}
+}
+
+func TestCoalescingUncacheable(t *testing.T) {
+	var active, peak int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for current := atomic.LoadInt32(&peak); n > current && !atomic.CompareAndSwapInt32(&peak, current, n); current = atomic.LoadInt32(&peak) {
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, "private")
+	}))
+	defer server.Close()
+
+	config := fmt.Sprintf(`{
+		"private" : {
+			"target" : {"verb" : "GET", "uri" : "%s"},
+			"mapping" : {"request.path" : "^/private$"},
+			"cache_strategy" : {"key" : "k", "duration_seconds" : 10, "cache_control" : true}
+		}
+	}`, server.URL)
+
+	mc := &memoryCache{entries: map[string][]byte{}}
+	for round := 0; round < 2; round++ {
+		atomic.StoreInt32(&peak, 0)
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				New(mc).Pipe(prepare(t, config, "/private"), w)
+				if w.Body.String() != "private" {
+					t.Errorf("unexpected body %q", w.Body.String())
+				}
+			}()
+		}
+		wg.Wait()
+		if atomic.LoadInt32(&peak) != 5 {
+			t.Errorf("round %d: expected uncacheable requests to run in parallel, got %d concurrent requests", round, peak)
+		}
+	}
+}
+
+func TestCacheAdmin(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		fmt.Fprint(w, "body")
+	}))
+	defer server.Close()
+
+	config := fmt.Sprintf(`{
+		"purgeable" : {
+			"target" : {"verb" : "GET", "uri" : "%s"},
+			"mapping" : {"request.path" : "^/purgeable$"},
+			"cache_strategy" : {"key" : "k", "duration_seconds" : 10}
+		}
+	}`, server.URL)
+
+	pipe := New(&memoryCache{entries: map[string][]byte{}})
+	w := httptest.NewRecorder()
+	pipe.Pipe(prepare(t, config, "/purgeable"), w)
+	w = httptest.NewRecorder()
+	pipe.Pipe(prepare(t, config, "/purgeable"), w)
+	key := w.Header().Get("X-Cache-Key")
+	if hits != 1 || key != "purgeable:k#0" {
+		t.Fatalf("expected cached response, got %d upstream requests and key %q", hits, key)
+	}
+
+	w = httptest.NewRecorder()
+	pipe.CacheAdmin(w, httptest.NewRequest("GET", "/_admin/cache?key="+key, nil))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &entry); err != nil || entry["size"] != float64(4) {
+		t.Errorf("unexpected inspection: %v %s", err, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	pipe.CacheAdmin(w, httptest.NewRequest("DELETE", "/_admin/cache?mapping=purgeable", nil))
+	if w.Code != 200 {
+		t.Fatalf("purge failed: %d %s", w.Code, w.Body.String())
+	}
+	pipe.Pipe(prepare(t, config, "/purgeable"), httptest.NewRecorder())
+	if hits != 2 {
+		t.Errorf("expected purged mapping to be fetched again, got %d upstream requests", hits)
+	}
+
+	w = httptest.NewRecorder()
+	pipe.CacheAdmin(w, httptest.NewRequest("DELETE", "/_admin/cache?key=missing", nil))
+	if w.Code != 200 {
+		t.Errorf("expected purging a missing key to succeed, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestStub(t *testing.T) {
+	rm := prepare(t, `{
+		"stubbed" : {
+			"target" : {
+				"stub" : true,
+				"status_code" : "{{if eq .match.id \"0\"}}404{{else}}200{{end}}",
+				"headers" : {"Content-Type" : "application/json", "X-Id" : "{{.match.id}}"},
+				"body" : "{\"id\" : {{.match.id}}}"
+			},
+			"mapping" : {"request.path" : "^/stubbed/(?P<id>\\d+)$"}
+		}
+	}`, "/stubbed/0")
+
+	w := httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(rm, w)
+	if w.Code != 404 || w.Body.String() != `{"id" : 0}` || w.Header().Get("X-Id") != "0" {
+		t.Errorf("unexpected stub response: %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+
+	rm = prepare(t, `{
+		"created" : {
+			"target" : {"stub" : true, "status_code" : 201, "body" : "created"},
+			"mapping" : {"request.path" : "^/created$"}
+		}
+	}`, "/created")
+
+	w = httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(rm, w)
+	if w.Code != 201 || w.Body.String() != "created" {
+		t.Errorf("unexpected stub response for a numeric status code: %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if atomic.AddInt32(&hits, 1)%3 != 0 {
+			w.WriteHeader(503)
+			return
+		}
+		fmt.Fprintf(w, "%s", body)
+	}))
+	defer server.Close()
+
+	config := `{
+		"retried" : {
+			"target" : {"verb" : "%s", "uri" : "%s", "body" : "{{.match.id}}"},
+			"mapping" : {"request.path" : "^/retried/(?P<id>\\d+)$"},
+			"retry" : {"max_attempts" : 3, "base_delay_ms" : 1}
+		}
+	}`
+
+	w := httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(prepare(t, fmt.Sprintf(config, "PUT", server.URL), "/retried/7"), w)
+	if w.Code != 200 || w.Body.String() != "7" || w.Header().Get("X-AProxy-Attempts") != "3" {
+		t.Errorf("unexpected retried response: %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(prepare(t, fmt.Sprintf(config, "POST", server.URL), "/retried/7"), w)
+	if w.Code != 503 || w.Header().Get("X-AProxy-Attempts") != "1" {
+		t.Errorf("expected POST not to be retried: %d %v", w.Code, w.Header())
+	}
+
+	atomic.StoreInt32(&hits, 0)
+	w = httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(prepare(t, fmt.Sprintf(config, "", server.URL), "/retried/7"), w)
+	if w.Code != 200 || w.Header().Get("X-AProxy-Attempts") != "3" {
+		t.Errorf("expected a target without verb to be retried as GET: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestRetryLargeBody(t *testing.T) {
+	var hits, received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		atomic.StoreInt32(&received, int32(len(body)))
+		w.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	rm := prepare(t, `{
+		"upload" : {
+			"target" : {"verb" : "PUT", "uri" : "`+server.URL+`"},
+			"mapping" : {"request.path" : "^/upload$"},
+			"retry" : {"max_attempts" : 3, "base_delay_ms" : 1}
+		}
+	}`, "/upload")
+	size := mappings.DefaultMaxBodySize + 10
+	rm.RequestStream = ioutil.NopCloser(strings.NewReader(strings.Repeat("x", size)))
+
+	w := httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(rm, w)
+	if w.Code != 503 || w.Header().Get("X-AProxy-Attempts") != "1" || atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("expected a single attempt, got %d %v after %d requests", w.Code, w.Header(), hits)
+	}
+	if int(atomic.LoadInt32(&received)) != size {
+		t.Errorf("expected the whole body of %d bytes upstream, got %d", size, received)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	server := upstream(500, "error")
+	defer server.Close()
+
+	if err := upstreams.Load(map[string]interface{}{
+		"fragile": map[string]interface{}{
+			"circuit_breaker": map[string]interface{}{"min_requests": float64(1), "open_ms": float64(60000)},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := fmt.Sprintf(`{
+		"fragile" : {
+			"target" : {"verb" : "GET", "uri" : "%s", "upstream" : "fragile"},
+			"mapping" : {"request.path" : "^/fragile$"},
+			"fallback" : {"status_code" : 200, "body" : "fallback {{.request.path}}"}
+		}
+	}`, server.URL)
+
+	w := httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(prepare(t, config, "/fragile"), w)
+	if w.Code != 500 {
+		t.Errorf("expected upstream error, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(prepare(t, config, "/fragile"), w)
+	if w.Code != 200 || w.Body.String() != "fallback /fragile" {
+		t.Errorf("expected fallback response, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestFanOutFallback(t *testing.T) {
+	search := upstream(200, `{"hits": 3}`)
+	defer search.Close()
+	profile := upstream(500, "error")
+	defer profile.Close()
+
+	if err := upstreams.Load(map[string]interface{}{
+		"fragile_profile": map[string]interface{}{
+			"circuit_breaker": map[string]interface{}{"min_requests": float64(1), "open_ms": float64(60000)},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := fmt.Sprintf(`{
+		"aggregate" : {
+			"target" : {
+				"targets" : {
+					"search" : {"verb" : "GET", "uri" : "%s"},
+					"profile" : {"verb" : "GET", "uri" : "%s", "upstream" : "fragile_profile"}
+				},
+				"transform" : {"type" : "json", "template" : "{{.data.search.hits}}"}
+			},
+			"mapping" : {"request.path" : "^/aggregate$"},
+			"fallback" : {"status_code" : 200, "body" : "fallback {{.request.path}}"}
+		}
+	}`, search.URL, profile.URL)
+
+	w := httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(prepare(t, config, "/aggregate"), w)
+	if w.Code != 502 {
+		t.Errorf("expected failing target, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(prepare(t, config, "/aggregate"), w)
+	if w.Code != 200 || w.Body.String() != "fallback /aggregate" || w.Header().Get("X-AProxy-Fallback") != "true" {
+		t.Errorf("expected fallback response, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRequestIdForwarded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("X-Request-Id"))
+	}))
+	defer server.Close()
+
+	rm := prepare(t, `{
+		"echo" : {
+			"target" : {"verb" : "GET", "uri" : "`+server.URL+`/echo"},
+			"mapping" : {"request.path" : "^/echo$"}
+		}
+	}`, "/echo")
+	(*rm.Data)["request"].(map[string]interface{})["id"] = "abc123"
+
+	w := httptest.NewRecorder()
+	New(&cache.NoopClient{}).Pipe(rm, w)
+	if w.Body.String() != "abc123" {
+		t.Errorf("expected request id to be forwarded, got %q", w.Body.String())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	config := `{
+		"limited" : {
+			"target" : {"stub" : true, "body" : "ok"},
+			"mapping" : {"request.path" : "^/limited$"},
+			"rate_limit" : {"key" : "{{.request.path}}", "rate" : 1, "per_seconds" : 60, "burst" : 2}
+		}
+	}`
+	// buckets belong to the loaded mapping, requests share one load
+	rm := prepare(t, config, "/limited")
+	remaining := []string{"1", "0", "0"}
+	for i, expected := range []int{200, 200, 429} {
+		w := httptest.NewRecorder()
+		next := *rm
+		New(&cache.NoopClient{}).Pipe(&next, w)
+		if w.Code != expected {
+			t.Errorf("request %d: expected %d, got %d", i, expected, w.Code)
+		}
+		if w.Header().Get("X-RateLimit-Limit") != "2" || w.Header().Get("X-RateLimit-Remaining") != remaining[i] {
+			t.Errorf("request %d: unexpected rate limit headers %v", i, w.Header())
+		}
+		if expected == 429 && w.Header().Get("Retry-After") == "" {
+			t.Errorf("expected Retry-After on rejection")
+		}
+	}
+	shared := New(memory.New(1024))
+	config = strings.Replace(config, `"burst" : 2`, `"shared" : true`, 1)
+	for i, expected := range []int{200, 429} {
+		w := httptest.NewRecorder()
+		shared.Pipe(prepare(t, config, "/limited"), w)
+		if w.Code != expected {
+			t.Errorf("shared request %d: expected %d, got %d", i, expected, w.Code)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package http
+
+import (
+	"github.com/creamdog/aproxy/metrics"
+	"net/http"
+)
+
+var requestsTotal = metrics.NewCounter("aproxy_requests_total", "Requests served per mapping and status code class.", "mapping", "code")
+var cacheRequests = metrics.NewCounter("aproxy_cache_requests_total", "Cache operations per mapping and result (hit, stale, miss, error).", "mapping", "result")
+var upstreamDuration = metrics.NewHistogram("aproxy_upstream_request_duration_seconds", "Latency of upstream requests per upstream and status code class.", nil, "upstream", "code")
+
+// statusRecorder remembers the status code written to the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	if sr.status == 0 {
+		sr.status = statusCode
+	}
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func (sr *statusRecorder) Status() int {
+	if sr.status == 0 {
+		return http.StatusOK
+	}
+	return sr.status
+}
@@ -0,0 +1,91 @@
+package http
+
+import (
+	"github.com/creamdog/aproxy/mappings"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ttl decides whether a response may be cached under the mapping strategy and
+// for how many seconds.
+func ttl(strategy *mappings.CacheStrategy, statusCode int, header http.Header) (int, bool) {
+	if !strategy.Caches(statusCode) {
+		return 0, false
+	}
+	seconds := strategy.Seconds
+	if strategy.CacheControl {
+		directives := cacheControl(header)
+		if _, exists := directives["no-store"]; exists {
+			return 0, false
+		}
+		if _, exists := directives["private"]; exists {
+			return 0, false
+		}
+		if _, exists := directives["no-cache"]; exists {
+			return 0, false
+		}
+		if age, err := strconv.Atoi(directives["s-maxage"]); err == nil {
+			seconds = age
+		} else if age, err := strconv.Atoi(directives["max-age"]); err == nil {
+			seconds = age
+		} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+			seconds = int(expires.Sub(time.Now()).Seconds())
+		} else if len(header.Get("Expires")) > 0 {
+			// invalid dates such as "0" mean already expired
+			return 0, false
+		}
+	}
+	if strategy.Vary && header.Get("Vary") == "*" {
+		return 0, false
+	}
+	return seconds, seconds > 0
+}
+
+func cacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+			name := strings.ToLower(parts[0])
+			if len(parts) == 2 {
+				directives[name] = strings.Trim(parts[1], "\"")
+			} else {
+				directives[name] = ""
+			}
+		}
+	}
+	return directives
+}
+
+// varyHeaders lists the lower-cased request header names of the upstream
+// Vary header.
+func varyHeaders(header http.Header) []string {
+	names := []string{}
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); len(name) > 0 {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// varyKey extends a cache key with the request values of the vary headers.
+func varyKey(key string, vary []string, data map[string]interface{}) string {
+	headers, _ := data["header"].(map[string]interface{})
+	for _, name := range vary {
+		value := ""
+		if str, isString := headers[name].(string); isString {
+			value = str
+		} else if strArray, isStringArray := headers[name].([]string); isStringArray {
+			value = strings.Join(strArray, ",")
+		}
+		key = key + "|" + name + "=" + value
+	}
+	return key
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"fmt"
+	"github.com/creamdog/aproxy/cache"
+	"github.com/creamdog/aproxy/mappings"
+	"github.com/creamdog/aproxy/metrics"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var rateLimited = metrics.NewCounter("aproxy_rate_limited_requests_total", "Requests rejected by the rate limit of a mapping.", "mapping")
+
+// takeShared counts the request in a fixed window shared through the cache,
+// allowing Rate requests per window of PerSeconds.
+func takeShared(counter cache.Counter, key string, limit *mappings.RateLimit, now time.Time) (mappings.Quota, error) {
+	window := now.Unix() / int64(limit.PerSeconds)
+	count, err := counter.Increment(fmt.Sprintf("ratelimit:%s:%d", key, window), limit.PerSeconds)
+	if err != nil {
+		return mappings.Quota{}, err
+	}
+	end := time.Unix((window+1)*int64(limit.PerSeconds), 0)
+	q := mappings.Quota{
+		Allowed:   count <= int64(limit.Rate),
+		Limit:     limit.Rate,
+		Remaining: int(math.Max(0, float64(int64(limit.Rate)-count))),
+		Reset:     end.Sub(now),
+	}
+	if !q.Allowed {
+		q.Retry = q.Reset
+	}
+	return q, nil
+}
+
+// limit applies the rate limit of the mapping and writes the X-RateLimit
+// headers, a request exceeding the limit is answered with 429 and false is
+// returned.
+func (pipe *HttpPipe) limit(mapping *mappings.RequestMapping, w http.ResponseWriter) bool {
+	limit := mapping.Mapping.RateLimit
+	if limit == nil {
+		return true
+	}
+	now := time.Now()
+
+	var q mappings.Quota
+	counter, shared := pipe.cache.(cache.Counter)
+	if shared = shared && limit.Shared; shared {
+		var err error
+		if q, err = takeShared(counter, mapping.Id+":"+mapping.RateLimitKey, limit, now); err != nil {
+			mapping.Log.Warnf("shared rate limit unavailable, limiting locally: %v", err)
+			shared = false
+		}
+	}
+	if !shared {
+		q = limit.Take(mapping.RateLimitKey, now)
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(q.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(q.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(q.Reset.Seconds()))))
+	if q.Allowed {
+		return true
+	}
+
+	rateLimited.Inc(mapping.Id)
+	pipe.span.SetAttribute("aproxy.rate_limited", true)
+	mapping.Log.Infof("rate limit exceeded for '%s'", mapping.RateLimitKey)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(q.Retry.Seconds())))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,109 @@
+package http
+
+import (
+	"fmt"
+	"github.com/creamdog/aproxy/log"
+	"github.com/creamdog/aproxy/mappings"
+	"github.com/creamdog/aproxy/metrics"
+	"github.com/creamdog/aproxy/tracing"
+	upstreams "github.com/creamdog/aproxy/upstream"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// do sends the request built by build, retrying connection errors and the
+// retryable status codes of the policy with backoff. Balanced upstreams pick
+// a server for every attempt, key selects the server of consistent hashing
+// and servers that failed a previous attempt are skipped. It returns the
+// last response or error along with the number of attempts, failed attempts
+// are logged to logger.
+func (pipe *HttpPipe) do(logger *log.Logger, u *upstreams.Upstream, policy *mappings.RetryPolicy, verb string, key string, build func() (*http.Request, error)) (*http.Response, int, error) {
+	attempts := policy.Attempts(verb)
+	var failed []*upstreams.Node
+	for attempt := 1; ; attempt++ {
+		request, err := build()
+		if err != nil {
+			return nil, attempt, err
+		}
+		var node *upstreams.Node
+		if u.Balancer != nil {
+			if len(key) == 0 {
+				key = request.URL.String()
+			}
+			node = u.Balancer.Pick(key, failed...)
+			request.URL = node.Resolve(request.URL)
+			request.Host = ""
+		}
+		breaker := u.Breaker(request.URL.Host)
+		if breaker != nil && !breaker.Allow() {
+			if node != nil {
+				node.Done()
+			}
+			return nil, attempt, upstreams.ErrCircuitOpen
+		}
+		span := pipe.span.Child("upstream.request", tracing.KindClient)
+		span.SetAttribute("http.method", request.Method)
+		span.SetAttribute("http.url", request.URL.String())
+		span.SetAttribute("aproxy.upstream", u.Name)
+		span.SetAttribute("aproxy.attempt", attempt)
+		span.Inject(request.Header)
+		started := time.Now()
+		response, err := u.Client.Do(request)
+		if err != nil {
+			upstreamDuration.Observe(time.Since(started).Seconds(), u.Name, "error")
+			span.SetError(err)
+		} else {
+			upstreamDuration.Observe(time.Since(started).Seconds(), u.Name, metrics.StatusClass(response.StatusCode))
+			span.SetAttribute("http.status_code", response.StatusCode)
+			if response.StatusCode >= 500 {
+				span.SetError(fmt.Errorf("status code %d", response.StatusCode))
+			}
+		}
+		span.Finish()
+		success := err == nil && response.StatusCode < 500
+		if breaker != nil {
+			breaker.Record(success)
+		}
+		if node != nil {
+			u.Balancer.Report(node, success)
+			if !success {
+				failed = append(failed, node)
+			}
+			if err != nil {
+				node.Done()
+			} else {
+				response.Body = &releasingBody{ReadCloser: response.Body, release: node.Done}
+			}
+		}
+		if attempt >= attempts || (err == nil && !policy.RetriesStatus(response.StatusCode)) {
+			return response, attempt, err
+		}
+		if err != nil {
+			logger.Warnf("attempt %d of %d to %s failed: %v", attempt, attempts, request.URL, err)
+		} else {
+			logger.Warnf("attempt %d of %d to %s returned %d", attempt, attempts, request.URL, response.StatusCode)
+			io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+			response.Body.Close()
+		}
+		select {
+		case <-time.After(policy.Backoff(attempt)):
+		case <-request.Context().Done():
+			return nil, attempt, request.Context().Err()
+		}
+	}
+}
+
+// releasingBody calls release once the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (rb *releasingBody) Close() error {
+	rb.once.Do(rb.release)
+	return rb.ReadCloser.Close()
+}
@@ -0,0 +1,19 @@
+package http
+
+import (
+	"fmt"
+	"github.com/creamdog/aproxy/mappings"
+	"net/http"
+)
+
+// stub answers with the rendered body, headers and status code of the target
+// without calling any upstream.
+func (pipe *HttpPipe) stub(mapping *mappings.RequestMapping, w http.ResponseWriter) {
+	mapping.Log.Debugf("stub response %d", mapping.StatusCode)
+	for key, value := range mapping.Headers {
+		w.Header().Set(key, value)
+	}
+	w.Header().Set("X-AProxy-Stub", "true")
+	w.WriteHeader(mapping.StatusCode)
+	fmt.Fprint(w, mapping.Body)
+}
@@ -0,0 +1,116 @@
+package http
+
+import (
+	"fmt"
+	"github.com/creamdog/aproxy/mappings"
+	upstreams "github.com/creamdog/aproxy/upstream"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type TargetResponse struct {
+	Name       string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Data       map[string]interface{}
+	Attempts   int
+	Err        error
+}
+
+// Ok reports whether the upstream call succeeded with a 2xx status and a
+// decodable body.
+func (tr *TargetResponse) Ok() bool {
+	return tr.Err == nil && tr.StatusCode >= 200 && tr.StatusCode < 300
+}
+
+func (tr *TargetResponse) Error() string {
+	if tr.Err != nil {
+		return tr.Err.Error()
+	} else if !tr.Ok() {
+		return fmt.Sprintf("unexpected status code %d", tr.StatusCode)
+	}
+	return ""
+}
+
+// Status is the per target status made available to transform templates.
+func (tr *TargetResponse) Status() map[string]interface{} {
+	return map[string]interface{}{
+		"status_code": tr.StatusCode,
+		"ok":          tr.Ok(),
+		"error":       tr.Error(),
+		"attempts":    tr.Attempts,
+	}
+}
+
+// forwardRequestId passes the id of the incoming request on to the upstream
+// unless the mapping sets the header itself.
+func forwardRequestId(mapping *mappings.RequestMapping, request *http.Request) {
+	id := mappings.RequestId(*mapping.Data)
+	if len(id) > 0 && len(request.Header.Get("X-Request-Id")) == 0 {
+		request.Header.Set("X-Request-Id", id)
+	}
+}
+
+// call renders the target templates with data, performs the upstream request
+// and decodes the response body of successful calls.
+func (pipe *HttpPipe) call(mapping *mappings.RequestMapping, target *mappings.CompiledTarget, data map[string]interface{}) *TargetResponse {
+	tr := &TargetResponse{Name: target.Name}
+
+	rt, err := target.Prepare(data)
+	if err != nil {
+		tr.Err = err
+		return tr
+	}
+
+	u, err := upstreams.Get(rt.Upstream)
+	if err != nil {
+		tr.Err = err
+		return tr
+	}
+	started := time.Now()
+	response, attempts, err := pipe.do(mapping.Log, u, mapping.Mapping.Retry, rt.Verb, rt.HashKey, func() (*http.Request, error) {
+		request, err := http.NewRequest(rt.Verb, rt.Uri, strings.NewReader(rt.Body))
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range rt.Headers {
+			request.Header[key] = []string{value}
+		}
+		forwardRequestId(mapping, request)
+		return request, nil
+	})
+	tr.Attempts = attempts
+	if err == nil {
+		pipe.entry.Upstream(rt.Uri, response.StatusCode, started)
+	} else if err != upstreams.ErrCircuitOpen {
+		pipe.entry.Upstream(rt.Uri, 0, started)
+	}
+	if err != nil {
+		tr.Err = err
+		return tr
+	}
+	defer response.Body.Close()
+
+	tr.StatusCode = response.StatusCode
+	tr.Header = response.Header
+	maxInputSize := mappings.DefaultMaxBodySize
+	if rt.Transform != nil {
+		maxInputSize = rt.Transform.MaxInputSize
+	}
+	if tr.Body, err = ioutil.ReadAll(io.LimitReader(response.Body, int64(maxInputSize)+1)); err != nil {
+		tr.Err = err
+		return tr
+	}
+	if len(tr.Body) > maxInputSize {
+		tr.Err = fmt.Errorf("maximum input size exceeded %d bytes", maxInputSize)
+		return tr
+	}
+	if tr.Ok() {
+		tr.Data, tr.Err = decode(rt.Transform, tr.Body)
+	}
+	return tr
+}
@@ -0,0 +1,228 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/creamdog/aproxy/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// exporter batches finished spans and posts them to an OTLP/HTTP collector
+// using the JSON encoding of ExportTraceServiceRequest.
+type exporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	batchSize   int
+	interval    time.Duration
+	client      *http.Client
+	queue       chan *Span
+	flush       chan chan bool
+	stop        chan bool
+	once        sync.Once
+	wg          sync.WaitGroup
+}
+
+func newExporter(endpoint string, config map[string]interface{}) (*exporter, error) {
+	e := &exporter{
+		endpoint:    endpoint,
+		headers:     map[string]string{},
+		serviceName: "aproxy",
+		batchSize:   512,
+		interval:    5 * time.Second,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		flush:       make(chan chan bool),
+		stop:        make(chan bool),
+	}
+	queueSize := 2048
+	if name, ok := config["service_name"].(string); ok {
+		e.serviceName = name
+	}
+	if size, ok := config["batch_size"].(float64); ok && size > 0 {
+		e.batchSize = int(size)
+	}
+	if size, ok := config["queue_size"].(float64); ok && size > 0 {
+		queueSize = int(size)
+	}
+	if ms, ok := config["flush_interval_ms"].(float64); ok && ms > 0 {
+		e.interval = time.Duration(ms) * time.Millisecond
+	}
+	if headers, ok := config["headers"].(map[string]interface{}); ok {
+		for key, value := range headers {
+			str, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("tracing header %s must be a string", key)
+			}
+			e.headers[key] = str
+		}
+	}
+	e.queue = make(chan *Span, queueSize)
+	e.wg.Add(1)
+	go e.run()
+	return e, nil
+}
+
+// export queues a span, spans are dropped while the queue is full.
+func (e *exporter) export(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		log.Warnf("tracing queue full, dropping span %s", span.Name)
+	}
+}
+
+func (e *exporter) run() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, e.batchSize)
+	send := func() {
+		if len(batch) > 0 {
+			if err := e.send(batch); err != nil {
+				log.Errorf("exporting %d spans failed: %v", len(batch), err)
+			}
+			batch = make([]*Span, 0, e.batchSize)
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case span := <-e.queue:
+				batch = append(batch, span)
+				if len(batch) >= e.batchSize {
+					send()
+				}
+			default:
+				send()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= e.batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-e.flush:
+			drain()
+			done <- true
+		case <-e.stop:
+			drain()
+			return
+		}
+	}
+}
+
+// forceFlush sends every queued span.
+func (e *exporter) forceFlush() {
+	done := make(chan bool)
+	e.flush <- done
+	<-done
+}
+
+func (e *exporter) shutdown() {
+	e.once.Do(func() {
+		close(e.stop)
+		e.wg.Wait()
+	})
+}
+
+func (e *exporter) send(spans []*Span) error {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		request.Header.Set(key, value)
+	}
+	response, err := e.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("collector responded %d", response.StatusCode)
+	}
+	return nil
+}
+
+func (e *exporter) encode(spans []*Span) map[string]interface{} {
+	encoded := make([]interface{}, 0, len(spans))
+	for _, span := range spans {
+		span.lock.Lock()
+		s := map[string]interface{}{
+			"traceId":           hex.EncodeToString(span.TraceId[:]),
+			"spanId":            hex.EncodeToString(span.SpanId[:]),
+			"name":              span.Name,
+			"kind":              span.Kind,
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes":        attributes(span.attributes),
+			"status":            map[string]interface{}{"code": 1},
+		}
+		if span.ParentId != [8]byte{} {
+			s["parentSpanId"] = hex.EncodeToString(span.ParentId[:])
+		}
+		if span.err != nil {
+			s["status"] = map[string]interface{}{"code": 2, "message": span.err.Error()}
+		}
+		span.lock.Unlock()
+		encoded = append(encoded, s)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": attributes(map[string]interface{}{"service.name": e.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/creamdog/aproxy"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+// attributes encodes attributes as OTLP key/value pairs.
+func attributes(values map[string]interface{}) []interface{} {
+	encoded := make([]interface{}, 0, len(values))
+	for key, value := range values {
+		var v map[string]interface{}
+		switch typed := value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": typed}
+		case bool:
+			v = map[string]interface{}{"boolValue": typed}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(typed)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(typed, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": typed}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(typed)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": key, "value": v})
+	}
+	return encoded
+}
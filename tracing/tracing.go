@@ -0,0 +1,283 @@
+// Package tracing records spans of request handling, propagates them to
+// upstreams with W3C traceparent headers and exports sampled spans over
+// OTLP/HTTP.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds as defined by OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+const TraceparentHeader = "traceparent"
+
+// Span is a timed operation of a trace, its methods do nothing on a nil span
+// so that code can be instrumented regardless of tracing being enabled.
+type Span struct {
+	tracer     *Tracer
+	Name       string
+	Kind       int
+	TraceId    [16]byte
+	SpanId     [8]byte
+	ParentId   [8]byte
+	Sampled    bool
+	Start      time.Time
+	End        time.Time
+	lock       sync.Mutex
+	attributes map[string]interface{}
+	err        error
+}
+
+// Child starts a span below s.
+func (s *Span) Child(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+	child := &Span{
+		tracer:     s.tracer,
+		Name:       name,
+		Kind:       kind,
+		TraceId:    s.TraceId,
+		ParentId:   s.SpanId,
+		Sampled:    s.Sampled,
+		Start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+	rand.Read(child.SpanId[:])
+	return child
+}
+
+// SetAttribute annotates the span, values are strings, bools or numbers.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = err
+}
+
+// Finish ends the span and queues it for export when sampled.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if !s.End.IsZero() {
+		s.lock.Unlock()
+		return
+	}
+	s.End = time.Now()
+	s.lock.Unlock()
+	if s.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.export(s)
+	}
+}
+
+// Traceparent formats the span context as a W3C traceparent header value.
+func (s *Span) Traceparent() string {
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(s.TraceId[:]), hex.EncodeToString(s.SpanId[:]), flags)
+}
+
+// Inject sets the traceparent header of an outgoing request to the span.
+func (s *Span) Inject(header http.Header) {
+	if s == nil {
+		return
+	}
+	header.Set(TraceparentHeader, s.Traceparent())
+}
+
+// parseTraceparent extracts the trace id, parent span id and sampled flag of
+// a version 00 traceparent header.
+func parseTraceparent(value string) (traceId [16]byte, parentId [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+	if _, err := hex.Decode(traceId[:], []byte(parts[1])); err != nil || traceId == [16]byte{} {
+		return
+	}
+	if _, err := hex.Decode(parentId[:], []byte(parts[2])); err != nil || parentId == [8]byte{} {
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return
+	}
+	return traceId, parentId, flags[0]&1 == 1, true
+}
+
+// Tracer starts root spans and samples new traces at SampleRate, traces
+// continued from an incoming traceparent keep the caller's decision.
+type Tracer struct {
+	SampleRate float64
+	exporter   *exporter
+	random     *mathrand.Rand
+	lock       sync.Mutex
+}
+
+// Start begins a server span for an incoming request, continuing the trace
+// of its traceparent header when present.
+func (t *Tracer) Start(name string, header http.Header) *Span {
+	if t == nil {
+		return nil
+	}
+	span := &Span{
+		tracer:     t,
+		Name:       name,
+		Kind:       KindServer,
+		Start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+	if traceId, parentId, sampled, ok := parseTraceparent(header.Get(TraceparentHeader)); ok {
+		span.TraceId, span.ParentId, span.Sampled = traceId, parentId, sampled
+	} else {
+		rand.Read(span.TraceId[:])
+		t.lock.Lock()
+		span.Sampled = t.random.Float64() < t.SampleRate
+		t.lock.Unlock()
+	}
+	rand.Read(span.SpanId[:])
+	return span
+}
+
+var tracer *Tracer
+
+// Configure enables tracing from the tracing config section: "sample_rate"
+// (0 to 1, default 1) and the OTLP/HTTP "endpoint" receiving sampled spans,
+// with optional "headers", "service_name", "batch_size", "queue_size" and
+// "flush_interval_ms". Tracing stays disabled without a config section.
+func Configure(config map[string]interface{}) error {
+	if config == nil {
+		return nil
+	}
+	t := &Tracer{SampleRate: 1, random: mathrand.New(mathrand.NewSource(time.Now().UnixNano()))}
+	if rate, ok := config["sample_rate"].(float64); ok {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("tracing sample_rate must be between 0 and 1: %v", rate)
+		}
+		t.SampleRate = rate
+	}
+	if endpoint, ok := config["endpoint"].(string); ok && len(endpoint) > 0 {
+		e, err := newExporter(endpoint, config)
+		if err != nil {
+			return err
+		}
+		t.exporter = e
+	}
+	tracer = t
+	return nil
+}
+
+// Shutdown exports the spans still queued.
+func Shutdown() {
+	if tracer != nil && tracer.exporter != nil {
+		tracer.exporter.shutdown()
+	}
+}
+
+// responseWriter carries the root span of a request.
+type responseWriter struct {
+	http.ResponseWriter
+	span   *Span
+	status int
+}
+
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	if rw.status == 0 {
+		rw.status = statusCode
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Wrap starts a root span for every request served by handler, handlers
+// retrieve it with From.
+func Wrap(handler http.Handler) http.Handler {
+	t := tracer
+	if t == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := t.Start("aproxy.request", r.Header)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		span.SetAttribute("http.host", r.Host)
+		if id := r.Header.Get("X-Request-Id"); len(id) > 0 {
+			span.SetAttribute("aproxy.request_id", id)
+		}
+		rw := &responseWriter{ResponseWriter: w, span: span}
+		defer func() {
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttribute("http.status_code", status)
+			if status >= 500 {
+				span.SetError(fmt.Errorf("status code %d", status))
+			}
+			span.Finish()
+		}()
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// From returns the root span of the request served through w, or nil.
+func From(w http.ResponseWriter) *Span {
+	for w != nil {
+		if rw, ok := w.(*responseWriter); ok {
+			return rw.span
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = unwrapper.Unwrap()
+	}
+	return nil
+}
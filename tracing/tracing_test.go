@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type collector struct {
+	lock  sync.Mutex
+	spans []map[string]interface{}
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]interface{} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(400)
+		return
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, rs := range request.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+	if err := Configure(map[string]interface{}{"endpoint": server.URL + "/v1/traces"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tracer = nil }()
+
+	var propagated string
+	handler := Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := From(w).Child("upstream.request", KindClient)
+		header := http.Header{}
+		span.Inject(header)
+		propagated = header.Get(TraceparentHeader)
+		span.Finish()
+	}))
+	request := httptest.NewRequest("GET", "/search", nil)
+	request.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	tracer.exporter.forceFlush()
+
+	if !strings.HasPrefix(propagated, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || !strings.HasSuffix(propagated, "-01") {
+		t.Errorf("expected trace to be propagated, got %s", propagated)
+	}
+	if len(c.spans) != 2 {
+		t.Fatalf("expected 2 exported spans, got %v", c.spans)
+	}
+	client, root := c.spans[0], c.spans[1]
+	if root["parentSpanId"] != "00f067aa0ba902b7" || client["parentSpanId"] != root["spanId"] || client["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected span hierarchy: %v", c.spans)
+	}
+	if !strings.Contains(propagated, client["spanId"].(string)) {
+		t.Errorf("expected propagated parent to be the client span: %s", propagated)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	Configure(map[string]interface{}{"sample_rate": 0.0})
+	defer func() { tracer = nil }()
+	if span := tracer.Start("request", http.Header{}); span.Sampled {
+		t.Errorf("expected new traces not to be sampled")
+	}
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if span := tracer.Start("request", header); !span.Sampled {
+		t.Errorf("expected sampled parent to be respected")
+	}
+	if _, _, _, ok := parseTraceparent("00-00000000000000000000000000000000-00f067aa0ba902b7-01"); ok {
+		t.Errorf("expected all-zero trace id to be rejected")
+	}
+}
@@ -0,0 +1,207 @@
+package upstream
+
+import (
+	"fmt"
+	"github.com/creamdog/aproxy/log"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RoundRobin       = "round_robin"
+	LeastConnections = "least_connections"
+	ConsistentHash   = "consistent_hash"
+	virtualNodes     = 100
+)
+
+// Node is one backend server of a balanced upstream.
+type Node struct {
+	URL          *url.URL
+	active       int64
+	lock         sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+	probeFailed  bool
+}
+
+// Done releases the connection slot taken when the node was picked.
+func (n *Node) Done() {
+	atomic.AddInt64(&n.active, -1)
+}
+
+func (n *Node) healthy(now time.Time) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return !n.probeFailed && now.After(n.ejectedUntil)
+}
+
+type ringEntry struct {
+	hash uint32
+	node *Node
+}
+
+// Balancer selects the node of a balanced upstream for every request and
+// passively tracks node health, nodes failing MaxFails times in a row are
+// ejected for Cooldown.
+type Balancer struct {
+	Strategy string
+	Nodes    []*Node
+	MaxFails int
+	Cooldown time.Duration
+	next     uint64
+	ring     []ringEntry
+}
+
+func parseBalancer(config map[string]interface{}) (*Balancer, error) {
+	servers, ok := config["servers"].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	b := &Balancer{
+		Strategy: RoundRobin,
+		MaxFails: intOrDefault(config["max_fails"], 3),
+		Cooldown: duration(config["fail_timeout_ms"], 10*time.Second),
+	}
+	if strategy, ok := config["balance"].(string); ok {
+		b.Strategy = strategy
+	}
+	switch b.Strategy {
+	case RoundRobin, LeastConnections, ConsistentHash:
+	default:
+		return nil, fmt.Errorf("unsupported balance strategy: %s", b.Strategy)
+	}
+	for _, server := range servers {
+		str, _ := server.(string)
+		u, err := url.Parse(str)
+		if err != nil || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid server url: %v", server)
+		}
+		b.Nodes = append(b.Nodes, &Node{URL: u})
+	}
+	if len(b.Nodes) == 0 {
+		return nil, fmt.Errorf("no servers specified")
+	}
+	for _, node := range b.Nodes {
+		for i := 0; i < virtualNodes; i++ {
+			b.ring = append(b.ring, ringEntry{hash: hash(node.URL.String() + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+	return b, nil
+}
+
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// Pick selects a healthy node, key is used by the consistent hash strategy.
+// Excluded nodes, such as the ones that failed previous attempts of a
+// request, are skipped while another healthy node is left. When every node
+// is ejected all of them are considered. The caller must call Done on the
+// node once the request completed.
+func (b *Balancer) Pick(key string, exclude ...*Node) *Node {
+	now := time.Now()
+	excluded := func(n *Node) bool {
+		for _, node := range exclude {
+			if node == n {
+				return true
+			}
+		}
+		return false
+	}
+	healthy := func(n *Node) bool { return true }
+	for _, candidate := range []func(*Node) bool{
+		func(n *Node) bool { return n.healthy(now) && !excluded(n) },
+		func(n *Node) bool { return n.healthy(now) },
+	} {
+		usable := false
+		for _, node := range b.Nodes {
+			if usable = candidate(node); usable {
+				break
+			}
+		}
+		if usable {
+			healthy = candidate
+			break
+		}
+	}
+
+	var picked *Node
+	switch b.Strategy {
+	case ConsistentHash:
+		h := hash(key)
+		start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+		for i := 0; i < len(b.ring) && picked == nil; i++ {
+			if entry := b.ring[(start+i)%len(b.ring)]; healthy(entry.node) {
+				picked = entry.node
+			}
+		}
+	case LeastConnections:
+		for _, node := range b.Nodes {
+			if healthy(node) && (picked == nil || atomic.LoadInt64(&node.active) < atomic.LoadInt64(&picked.active)) {
+				picked = node
+			}
+		}
+	default:
+		start := atomic.AddUint64(&b.next, 1)
+		for i := 0; i < len(b.Nodes) && picked == nil; i++ {
+			if node := b.Nodes[(start+uint64(i))%uint64(len(b.Nodes))]; healthy(node) {
+				picked = node
+			}
+		}
+	}
+	atomic.AddInt64(&picked.active, 1)
+	return picked
+}
+
+// Report records the outcome of a request to the node.
+func (b *Balancer) Report(node *Node, success bool) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if success {
+		node.failures = 0
+		return
+	}
+	node.failures++
+	if node.failures >= b.MaxFails {
+		log.Warnf("ejecting %v for %v after %d failures", node.URL, b.Cooldown, node.failures)
+		node.ejectedUntil = time.Now().Add(b.Cooldown)
+		node.failures = 0
+	}
+}
+
+// Resolve points the target url at the node, relative urls are appended to
+// the node url and absolute urls have their scheme and host replaced.
+func (n *Node) Resolve(target *url.URL) *url.URL {
+	resolved := *target
+	resolved.Scheme = n.URL.Scheme
+	resolved.Host = n.URL.Host
+	if !target.IsAbs() {
+		resolved.Path = strings.TrimSuffix(n.URL.Path, "/") + target.Path
+	}
+	return &resolved
+}
+
+// Status describes the nodes for the status endpoint.
+func (b *Balancer) Status() []map[string]interface{} {
+	now := time.Now()
+	status := []map[string]interface{}{}
+	for _, node := range b.Nodes {
+		status = append(status, map[string]interface{}{
+			"url":     node.URL.String(),
+			"active":  atomic.LoadInt64(&node.active),
+			"healthy": node.healthy(now),
+		})
+	}
+	return status
+}
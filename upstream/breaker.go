@@ -0,0 +1,167 @@
+package upstream
+
+import (
+	"errors"
+	"github.com/creamdog/aproxy/log"
+	"sync"
+	"time"
+)
+
+const (
+	Closed   = "closed"
+	Open     = "open"
+	HalfOpen = "half-open"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type BreakerConfig struct {
+	FailureRate      float64
+	MinRequests      int
+	Window           time.Duration
+	OpenDuration     time.Duration
+	HalfOpenRequests int
+}
+
+func parseBreakerConfig(value interface{}) *BreakerConfig {
+	config, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	rate := 0.5
+	if value, ok := config["failure_rate"].(float64); ok {
+		rate = value
+	}
+	return &BreakerConfig{
+		FailureRate:      rate,
+		MinRequests:      intOrDefault(config["min_requests"], 20),
+		Window:           duration(config["window_ms"], 10*time.Second),
+		OpenDuration:     duration(config["open_ms"], 30*time.Second),
+		HalfOpenRequests: intOrDefault(config["half_open_requests"], 1),
+	}
+}
+
+// Breaker stops requests to a failing upstream. It opens once the failure
+// rate within a window exceeds the configured rate, rejects requests while
+// open and after OpenDuration lets a limited number of probe requests through
+// (half-open) whose outcome closes or reopens it.
+type Breaker struct {
+	Key      string
+	config   *BreakerConfig
+	lock     sync.Mutex
+	state    string
+	since    time.Time
+	requests int
+	failures int
+	probes   int
+}
+
+func newBreaker(key string, config *BreakerConfig) *Breaker {
+	return &Breaker{Key: key, config: config, state: Closed, since: time.Now()}
+}
+
+// Allow reports whether a request may be sent, every allowed request must be
+// followed by a call to Record.
+func (b *Breaker) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	switch b.state {
+	case Open:
+		if now.Sub(b.since) < b.config.OpenDuration {
+			return false
+		}
+		b.transition(HalfOpen, now)
+		fallthrough
+	case HalfOpen:
+		if b.probes >= b.config.HalfOpenRequests {
+			return false
+		}
+		b.probes++
+		return true
+	}
+	if now.Sub(b.since) > b.config.Window {
+		b.since, b.requests, b.failures = now, 0, 0
+	}
+	return true
+}
+
+func (b *Breaker) Record(success bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	switch b.state {
+	case HalfOpen:
+		if success {
+			b.transition(Closed, now)
+		} else {
+			b.transition(Open, now)
+		}
+	case Closed:
+		b.requests++
+		if !success {
+			b.failures++
+		}
+		if b.requests >= b.config.MinRequests && float64(b.failures)/float64(b.requests) >= b.config.FailureRate {
+			b.transition(Open, now)
+		}
+	}
+}
+
+func (b *Breaker) transition(state string, now time.Time) {
+	log.Warnf("circuit breaker %v: %v => %v (%d/%d failed)", b.Key, b.state, state, b.failures, b.requests)
+	b.state, b.since = state, now
+	b.requests, b.failures, b.probes = 0, 0, 0
+}
+
+func (b *Breaker) State() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// Status describes the breaker for the status endpoint.
+func (b *Breaker) Status() map[string]interface{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return map[string]interface{}{
+		"state":    b.state,
+		"since":    b.since.Format(time.RFC3339),
+		"requests": b.requests,
+		"failures": b.failures,
+	}
+}
+
+var breakersLock = &sync.Mutex{}
+var breakers = map[string]*Breaker{}
+
+// Breaker returns the circuit breaker guarding requests to host, named
+// upstreams share one breaker for all their hosts while the default upstream
+// keeps one per host. It is nil when no circuit breaker is configured.
+func (u *Upstream) Breaker(host string) *Breaker {
+	if u.breakerConfig == nil {
+		return nil
+	}
+	key := u.Name
+	if u.Name == "default" {
+		key = host
+	}
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	if b, exists := breakers[key]; exists && b.config == u.breakerConfig {
+		return b
+	}
+	breakers[key] = newBreaker(key, u.breakerConfig)
+	return breakers[key]
+}
+
+// Breakers returns the status of every circuit breaker by key.
+func Breakers() map[string]interface{} {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+	status := map[string]interface{}{}
+	for key, b := range breakers {
+		status[key] = b.Status()
+	}
+	return status
+}
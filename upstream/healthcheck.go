@@ -0,0 +1,132 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/creamdog/aproxy/health"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheck actively probes an upstream, balanced upstreams probe Path on
+// every server and take failing servers out of rotation while other
+// upstreams probe Url.
+type HealthCheck struct {
+	Path     string
+	Url      string
+	Interval time.Duration
+	Timeout  time.Duration
+	Critical bool
+}
+
+func parseHealthCheck(value interface{}, balancer *Balancer) (*HealthCheck, error) {
+	config, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	hc := &HealthCheck{
+		Path:     "/",
+		Interval: duration(config["interval_ms"], 10*time.Second),
+		Timeout:  duration(config["timeout_ms"], 2*time.Second),
+		Critical: true,
+	}
+	if path, ok := config["path"].(string); ok {
+		hc.Path = path
+	}
+	if url, ok := config["url"].(string); ok {
+		hc.Url = url
+	}
+	if critical, ok := config["critical"].(bool); ok {
+		hc.Critical = critical
+	}
+	if balancer == nil && len(hc.Url) == 0 {
+		return nil, fmt.Errorf("health check requires a url for upstreams without servers")
+	}
+	return hc, nil
+}
+
+var healthChecksLock = &sync.Mutex{}
+var healthChecks = map[string]func(){}
+
+func (u *Upstream) startHealthCheck() {
+	healthChecksLock.Lock()
+	defer healthChecksLock.Unlock()
+	if stop, exists := healthChecks[u.Name]; exists {
+		stop()
+		delete(healthChecks, u.Name)
+	}
+	if u.HealthCheck == nil {
+		return
+	}
+	healthChecks[u.Name] = health.Probe("upstream:"+u.Name, u.HealthCheck.Critical, u.HealthCheck.Interval, u.probe)
+}
+
+// StopHealthChecks stops probing every upstream.
+func StopHealthChecks() {
+	healthChecksLock.Lock()
+	defer healthChecksLock.Unlock()
+	for name, stop := range healthChecks {
+		stop()
+		delete(healthChecks, name)
+	}
+}
+
+// probe checks every server of the upstream, the upstream is unhealthy when
+// none of them responds successfully.
+func (u *Upstream) probe() (interface{}, error) {
+	results := map[string]interface{}{}
+	healthy := 0
+	if u.Balancer == nil {
+		err := u.probeUrl(u.HealthCheck.Url)
+		results[u.HealthCheck.Url] = probeResult(err)
+		if err == nil {
+			healthy++
+		}
+	} else {
+		for _, node := range u.Balancer.Nodes {
+			url := strings.TrimSuffix(node.URL.String(), "/") + u.HealthCheck.Path
+			err := u.probeUrl(url)
+			results[url] = probeResult(err)
+			node.lock.Lock()
+			node.probeFailed = err != nil
+			node.lock.Unlock()
+			if err == nil {
+				healthy++
+			}
+		}
+	}
+	if healthy == 0 {
+		return results, fmt.Errorf("no healthy servers")
+	}
+	return results, nil
+}
+
+func (u *Upstream) probeUrl(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), u.HealthCheck.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := u.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+	return nil
+}
+
+func probeResult(err error) map[string]interface{} {
+	if err != nil {
+		return map[string]interface{}{"healthy": false, "error": err.Error()}
+	}
+	return map[string]interface{}{"healthy": true}
+}
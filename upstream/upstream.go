@@ -0,0 +1,192 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/creamdog/aproxy/log"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConnectTimeout = 5 * time.Second
+	defaultReadTimeout    = 30 * time.Second
+	defaultTimeout        = 60 * time.Second
+	defaultMaxIdleConns   = 100
+	defaultMaxIdlePerHost = 10
+)
+
+// Upstream is a named backend definition sharing one client and connection
+// pool between every mapping referencing it.
+type Upstream struct {
+	Name          string
+	Client        *http.Client
+	Balancer      *Balancer
+	HealthCheck   *HealthCheck
+	breakerConfig *BreakerConfig
+}
+
+var lock = &sync.RWMutex{}
+var registry = map[string]*Upstream{}
+var defaultUpstream = mustNew("default", map[string]interface{}{})
+
+// Load registers the upstreams of the "upstreams" configuration section,
+// replacing previously registered upstreams of the same name.
+func Load(config map[string]interface{}) error {
+	for name, value := range config {
+		section, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid upstream configuration: %s", name)
+		}
+		u, err := New(name, section)
+		if err != nil {
+			return fmt.Errorf("upstream %s: %v", name, err)
+		}
+		lock.Lock()
+		if name == "default" {
+			defaultUpstream = u
+		}
+		registry[name] = u
+		lock.Unlock()
+		u.startHealthCheck()
+		log.Infof("loaded upstream '%v'", name)
+	}
+	return nil
+}
+
+// Get returns the named upstream, the empty name refers to the default
+// upstream used by targets not referencing one. It can be configured as the
+// upstream named "default".
+func Get(name string) (*Upstream, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+	if len(name) == 0 {
+		return defaultUpstream, nil
+	}
+	if u, exists := registry[name]; exists {
+		return u, nil
+	}
+	return nil, fmt.Errorf("unknown upstream: %s", name)
+}
+
+// Status describes the registered upstreams for the status endpoint.
+func Status() map[string]interface{} {
+	lock.RLock()
+	defer lock.RUnlock()
+	status := map[string]interface{}{}
+	for name, u := range registry {
+		s := map[string]interface{}{}
+		if u.Balancer != nil {
+			s["balance"] = u.Balancer.Strategy
+			s["servers"] = u.Balancer.Status()
+		}
+		status[name] = s
+	}
+	return status
+}
+
+func New(name string, config map[string]interface{}) (*Upstream, error) {
+	connectTimeout := duration(config["connect_timeout_ms"], defaultConnectTimeout)
+
+	tlsConfig, err := loadTLS(config["tls"])
+	if err != nil {
+		return nil, err
+	}
+
+	balancer, err := parseBalancer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	healthCheck, err := parseHealthCheck(config["health_check"], balancer)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: duration(config["read_timeout_ms"], defaultReadTimeout),
+		MaxIdleConns:          intOrDefault(config["max_idle_conns"], defaultMaxIdleConns),
+		MaxIdleConnsPerHost:   intOrDefault(config["max_idle_conns_per_host"], defaultMaxIdlePerHost),
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	return &Upstream{
+		Name: name,
+		Client: &http.Client{
+			Transport: transport,
+			Timeout:   duration(config["timeout_ms"], defaultTimeout),
+		},
+		Balancer:      balancer,
+		HealthCheck:   healthCheck,
+		breakerConfig: parseBreakerConfig(config["circuit_breaker"]),
+	}, nil
+}
+
+func mustNew(name string, config map[string]interface{}) *Upstream {
+	u, err := New(name, config)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func loadTLS(value interface{}) (*tls.Config, error) {
+	config, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+	if skip, ok := config["insecure_skip_verify"].(bool); ok && skip {
+		log.Warnf("upstream certificate verification disabled")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if caFile, ok := config["ca_file"].(string); ok {
+		bytes, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bytes) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	certFile, hasCert := config["cert_file"].(string)
+	keyFile, hasKey := config["key_file"].(string)
+	if hasCert != hasKey {
+		return nil, fmt.Errorf("client certificates require both cert_file and key_file")
+	}
+	if hasCert {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+func duration(v interface{}, fallback time.Duration) time.Duration {
+	if value, ok := v.(float64); ok {
+		return time.Duration(value) * time.Millisecond
+	}
+	return fallback
+}
+
+func intOrDefault(v interface{}, fallback int) int {
+	if value, ok := v.(float64); ok {
+		return int(value)
+	}
+	return fallback
+}
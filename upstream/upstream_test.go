@@ -0,0 +1,163 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	if err := Load(map[string]interface{}{
+		"slow": map[string]interface{}{"read_timeout_ms": float64(50)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	u, err := Get("slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Client.Get(server.URL); err == nil {
+		t.Errorf("expected timeout")
+	}
+	if _, err := Get("missing"); err == nil {
+		t.Errorf("expected unknown upstream error")
+	}
+}
+
+func TestTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	u, _ := Get("")
+	if _, err := u.Client.Get(server.URL); err == nil {
+		t.Errorf("expected unknown authority error")
+	}
+
+	insecure, err := New("insecure", map[string]interface{}{
+		"tls": map[string]interface{}{"insecure_skip_verify": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insecure.Client.Get(server.URL); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker("test", &BreakerConfig{
+		FailureRate:      0.5,
+		MinRequests:      4,
+		Window:           time.Minute,
+		OpenDuration:     50 * time.Millisecond,
+		HalfOpenRequests: 1,
+	})
+
+	for _, success := range []bool{true, false, true, false} {
+		if !b.Allow() {
+			t.Fatalf("expected closed breaker to allow requests")
+		}
+		b.Record(success)
+	}
+	if b.State() != Open || b.Allow() {
+		t.Fatalf("expected open breaker, got %s", b.State())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() || b.State() != HalfOpen {
+		t.Fatalf("expected half-open probe, got %s", b.State())
+	}
+	if b.Allow() {
+		t.Errorf("expected a single probe")
+	}
+	b.Record(true)
+	if b.State() != Closed {
+		t.Errorf("expected closed breaker after successful probe, got %s", b.State())
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	servers := []interface{}{"http://a:9200", "http://b:9200/prefix", "http://c:9200"}
+	b, err := parseBalancer(map[string]interface{}{"servers": servers, "max_fails": float64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		node := b.Pick("")
+		seen[node.URL.Host] = true
+		node.Done()
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected round robin over every server, got %v", seen)
+	}
+
+	b.Report(b.Nodes[0], false)
+	for i := 0; i < 3; i++ {
+		if node := b.Pick(""); node == b.Nodes[0] {
+			t.Errorf("expected ejected node not to be picked")
+		}
+	}
+
+	target, _ := url.Parse("/_search?q=1")
+	if resolved := b.Nodes[1].Resolve(target).String(); resolved != "http://b:9200/prefix/_search?q=1" {
+		t.Errorf("unexpected resolved url: %s", resolved)
+	}
+
+	b, _ = parseBalancer(map[string]interface{}{"servers": servers, "balance": "consistent_hash"})
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if b.Pick(key) != b.Pick(key) {
+			t.Errorf("expected consistent node for key %s", key)
+		}
+		if failed := b.Pick(key); b.Pick(key, failed) == failed {
+			t.Errorf("expected excluded node to be skipped for key %s", key)
+		}
+	}
+
+	b, _ = parseBalancer(map[string]interface{}{"servers": servers, "balance": "least_connections"})
+	busy := b.Pick("")
+	if next := b.Pick(""); next == busy {
+		t.Errorf("expected least connections to avoid busy node")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(404)
+		}
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer failing.Close()
+
+	u, err := New("search", map[string]interface{}{
+		"servers":      []interface{}{healthy.URL, failing.URL},
+		"health_check": map[string]interface{}{"path": "/health"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.probe(); err != nil {
+		t.Fatalf("expected upstream with a healthy server to be healthy: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if node := u.Balancer.Pick(""); node == u.Balancer.Nodes[1] {
+			t.Errorf("expected node failing its probe not to be picked")
+		}
+	}
+
+	healthy.Close()
+	if _, err := u.probe(); err == nil {
+		t.Errorf("expected upstream without healthy servers to be unhealthy")
+	}
+}